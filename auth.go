@@ -0,0 +1,147 @@
+package layer
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j/auth"
+	"strings"
+	"time"
+)
+
+const (
+	AuthSchemeBasic    = "basic"
+	AuthSchemeBearer   = "bearer"
+	AuthSchemeKerberos = "kerberos"
+	AuthSchemeNone     = "none"
+)
+
+// tokenManager returns the auth of the bolt driver. Basic credentials and bearer tokens are resolved
+// again by the driver when the server rejects them or a token expires.
+func (c Credentials) tokenManager() (auth.TokenManager, error) {
+	switch c.Scheme {
+	case AuthSchemeNone:
+		return neo4j.NoAuth(), nil
+	case AuthSchemeKerberos:
+		ticket, err := c.resolveToken()
+		if err != nil {
+			return nil, err
+		}
+		return neo4j.KerberosAuth(ticket), nil
+	case AuthSchemeBearer:
+		// fails the connection straight away when the token cannot be read
+		if _, err := c.resolveToken(); err != nil {
+			return nil, err
+		}
+		return auth.BearerTokenManager(func(ctx context.Context) (neo4j.AuthToken, *time.Time, error) {
+			token, err := c.resolveToken()
+			if err != nil {
+				return neo4j.AuthToken{}, nil, err
+			}
+			return neo4j.BearerAuth(token), tokenExpiry(token), nil
+		}), nil
+	default:
+		if _, _, err := c.Resolve(); err != nil {
+			return nil, err
+		}
+		return auth.BasicTokenManager(func(ctx context.Context) (neo4j.AuthToken, error) {
+			username, password, err := c.Resolve()
+			if err != nil {
+				return neo4j.AuthToken{}, err
+			}
+			return neo4j.BasicAuth(username, password, c.Realm), nil
+		}), nil
+	}
+}
+
+// authorization returns the Authorization header of the query api, empty for no auth
+func (c Credentials) authorization() (string, error) {
+	switch c.Scheme {
+	case AuthSchemeNone:
+		return "", nil
+	case AuthSchemeKerberos:
+		return "", fmt.Errorf("the query api does not support kerberos auth, use a bolt endpoint")
+	case AuthSchemeBearer:
+		token, err := c.resolveToken()
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	default:
+		username, password, err := c.Resolve()
+		if err != nil {
+			return "", err
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+}
+
+// tokenExpiry reads the expiry of a jwt bearer token so the driver fetches a new token in time, nil
+// for tokens that are not jwts or do not expire
+func tokenExpiry(token string) *time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+	claims := struct {
+		Expires int64 `json:"exp"`
+	}{}
+	if json.Unmarshal(payload, &claims) != nil || claims.Expires == 0 {
+		return nil
+	}
+	expiry := time.Unix(claims.Expires, 0)
+	return &expiry
+}
+
+// checkCredentials adds a problem for each secret the auth scheme needs but is missing, and for
+// variables and files that cannot be resolved
+func checkCredentials(credentials Credentials, http bool, problems *configProblems) {
+	secrets := []struct{ key, value, file string }{
+		{"username", credentials.Username, credentials.UsernameFile},
+		{"password", credentials.Password, credentials.PasswordFile},
+		{"token", credentials.Token, credentials.TokenFile},
+	}
+	scheme := credentials.Scheme
+	if scheme == "" {
+		scheme = AuthSchemeBasic
+	}
+	required := map[string]bool{}
+	switch scheme {
+	case AuthSchemeBasic:
+		required["username"], required["password"] = true, true
+	case AuthSchemeBearer:
+		required["token"] = true
+	case AuthSchemeKerberos:
+		required["token"] = true
+		if http {
+			problems.add("auth_scheme %s is not supported by the query api, use a bolt endpoint", scheme)
+		}
+	case AuthSchemeNone:
+	default:
+		problems.add("unsupported auth_scheme %s, must be %s, %s, %s or %s", scheme, AuthSchemeBasic, AuthSchemeBearer, AuthSchemeKerberos, AuthSchemeNone)
+		return
+	}
+
+	for _, secret := range secrets {
+		switch {
+		case !required[secret.key] && (secret.value != "" || secret.file != ""):
+			problems.add("%s is not used by auth_scheme %s", secret.key, scheme)
+		case required[secret.key] && secret.value == "" && secret.file == "":
+			problems.add("no %s or %s_file specified", secret.key, secret.key)
+		case secret.value != "" && secret.file != "":
+			problems.add("only one of %s and %s_file may be specified", secret.key, secret.key)
+		case required[secret.key]:
+			// resolved once here to report missing variables and files, and again for every connection
+			_, err := resolveSecret(secret.key, secret.value, secret.file)
+			if err != nil {
+				problems.add("%s", err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package layer
+
+import (
+	"context"
+	"encoding/base64"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthSchemes(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("token-1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(&fakeQueryAPI{token: "token-1"})
+	defer server.Close()
+	client := NewNeo4jClient(server.URL, "", Credentials{Scheme: AuthSchemeBearer, TokenFile: tokenFile}, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if status := client.CheckHealth(context.Background(), nil); !status.Healthy {
+		t.Errorf("Expected bearer token to be accepted, got %+v", status)
+	}
+	client = NewNeo4jClient(server.URL, "", Credentials{Scheme: AuthSchemeBasic, Username: "neo4j", Password: "secret"}, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if status := client.CheckHealth(context.Background(), nil); status.Healthy {
+		t.Errorf("Expected basic auth to be rejected, got %+v", status)
+	}
+
+	problems := configProblems{}
+	checkCredentials(Credentials{Scheme: AuthSchemeKerberos, Username: "neo4j"}, true, &problems)
+	expected := "auth_scheme kerberos is not supported by the query api, use a bolt endpoint; username is not used by auth_scheme kerberos; no token or token_file specified"
+	if problems.Error() != expected {
+		t.Errorf("Unexpected problems %s", problems.Error())
+	}
+
+	// the expiry of jwt bearer tokens is passed on to the driver
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"layer","exp":1893456000}`))
+	expiry := tokenExpiry(strings.Join([]string{"eyJhbGciOiJIUzI1NiJ9", payload, "c2lnbmF0dXJl"}, "."))
+	if expiry == nil || !expiry.Equal(time.Unix(1893456000, 0)) {
+		t.Errorf("Unexpected expiry %v", expiry)
+	}
+	if tokenExpiry("opaque-token") != nil {
+		t.Error("Expected no expiry for an opaque token")
+	}
+}
@@ -0,0 +1,383 @@
+package layer
+
+import (
+	"encoding/csv"
+	"fmt"
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FullSyncModeTransactional = "transactional"
+	FullSyncModeBulkImport    = "bulk_import"
+)
+
+// name of the neo4j-admin argument file written when the last batch of a full sync is closed
+const BulkImportArgsFile = "import.args"
+
+// BulkImportDatasetWriter streams entities to neo4j-admin compatible node and relationship csv files.
+// Each flushed batch produces its own set of files with inline headers, so the column set can differ
+// between batches. Target nodes of references are written to separate stub files that only carry the
+// gid, these overlap with real nodes and the import must be run with --skip-duplicate-nodes=true.
+type BulkImportDatasetWriter struct {
+	logger      cdl.Logger
+	dir         string
+	datasetName string
+	label       string
+	BatchSize   int
+	vectors     map[string]int // dimensions of the embedding properties
+	batchInfo   cdl.BatchInfo
+	toWrite     []*egdm.Entity
+	part        int // number of the next set of files
+}
+
+func NewBulkImportDatasetWriter(dir string, datasetName string, label string, batchSize int, vectors map[string]int, batchInfo cdl.BatchInfo, logger cdl.Logger) (*BulkImportDatasetWriter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if batchInfo.IsStartBatch {
+		// a new full sync replaces the files of earlier runs, other files in the folder are left alone
+		logger.Debug(fmt.Sprintf("clearing bulk import files in folder %s for dataset %s", dir, datasetName))
+		err = removeBulkImportFiles(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// earlier requests of the same full sync have written files already, the folder is only read
+	// here so that flushing stays cheap however many files it holds
+	part, err := nextPart(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BulkImportDatasetWriter{
+		logger:      logger,
+		dir:         dir,
+		datasetName: datasetName,
+		label:       label,
+		BatchSize:   batchSize,
+		vectors:     vectors,
+		batchInfo:   batchInfo,
+		toWrite:     make([]*egdm.Entity, 0),
+		part:        part,
+	}, nil
+}
+
+func (w *BulkImportDatasetWriter) Write(entity *egdm.Entity) cdl.LayerError {
+	w.toWrite = append(w.toWrite, entity)
+	if len(w.toWrite) >= w.BatchSize {
+		err := w.flush()
+		if err != nil {
+			return cdl.Err(fmt.Errorf("could not write bulk import files because %s", err.Error()), cdl.LayerErrorInternal)
+		}
+	}
+	return nil
+}
+
+func (w *BulkImportDatasetWriter) Close() cdl.LayerError {
+	w.logger.Info(fmt.Sprintf("closing bulk import writer for dataset %s", w.datasetName))
+	if len(w.toWrite) > 0 {
+		err := w.flush()
+		if err != nil {
+			return cdl.Err(fmt.Errorf("could not write bulk import files because %s", err.Error()), cdl.LayerErrorInternal)
+		}
+	}
+
+	if w.batchInfo.IsLastBatch {
+		err := w.writeArgsFile()
+		if err != nil {
+			return cdl.Err(fmt.Errorf("could not write bulk import args file because %s", err.Error()), cdl.LayerErrorInternal)
+		}
+	}
+	return nil
+}
+
+// flush writes the buffered entities to the next numbered set of csv files
+func (w *BulkImportDatasetWriter) flush() error {
+	w.logger.Debug(fmt.Sprintf("writing bulk import batch of %d entities for dataset %s", len(w.toWrite), w.datasetName))
+
+	part := w.part
+	w.part++
+	var err error
+
+	nodeItems := make([]map[string]interface{}, 0, len(w.toWrite))
+	targets := make(map[string]bool)
+	relationships := make([][]string, 0)
+
+	for _, entity := range w.toWrite {
+		// deleted entities are simply left out of a full load
+		if entity.IsDeleted {
+			continue
+		}
+
+		item, err := nodeItem(w.datasetName, entity, w.vectors)
+		if err != nil {
+			return err
+		}
+		nodeItems = append(nodeItems, item)
+
+		for property, rel := range entity.References {
+			related, err := referenceTargets(rel)
+			if err != nil {
+				return err
+			}
+			for _, target := range related {
+				targets[target] = true
+				relationships = append(relationships, []string{entity.ID, target, stripPrefix(property), w.datasetName})
+			}
+		}
+	}
+
+	if len(nodeItems) > 0 {
+		err = w.writeNodes(filepath.Join(w.dir, fmt.Sprintf("nodes-%06d.csv", part)), nodeItems)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(targets) > 0 {
+		rows := make([][]string, 0, len(targets))
+		for target := range targets {
+			rows = append(rows, []string{target})
+		}
+		sort.Slice(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+		err = writeCsv(filepath.Join(w.dir, fmt.Sprintf("targets-%06d.csv", part)), []string{"gid:ID"}, rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(relationships) > 0 {
+		err = writeCsv(filepath.Join(w.dir, fmt.Sprintf("relationships-%06d.csv", part)),
+			[]string{":START_ID", ":END_ID", ":TYPE", "source"}, relationships)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.toWrite = make([]*egdm.Entity, 0)
+	return nil
+}
+
+// isBulkImportFile tells whether a file in the folder was written by a bulk import writer
+func isBulkImportFile(name string) bool {
+	if name == BulkImportArgsFile {
+		return true
+	}
+	for _, prefix := range []string{"nodes-", "targets-", "relationships-"} {
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".csv") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeBulkImportFiles removes the files written by earlier full syncs
+func removeBulkImportFiles(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && isBulkImportFile(entry.Name()) {
+			err = os.Remove(filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nextPart returns the number to use for the next set of files in the folder
+func nextPart(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	part := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == BulkImportArgsFile || !isBulkImportFile(name) {
+			continue
+		}
+		i := strings.LastIndex(name, "-")
+		if i == -1 {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(name[i+1:], ".csv"))
+		if err == nil && n >= part {
+			part = n + 1
+		}
+	}
+	return part, nil
+}
+
+func (w *BulkImportDatasetWriter) writeNodes(fileName string, items []map[string]interface{}) error {
+	// collect the columns and their types for this batch
+	types := make(map[string]string)
+	for _, item := range items {
+		for k, v := range item {
+			if k == "gid" || v == nil {
+				continue
+			}
+			t := csvType(v)
+			if existing, ok := types[k]; ok && existing != t {
+				t = csvStringType(existing, t)
+			}
+			types[k] = t
+		}
+	}
+
+	columns := make([]string, 0, len(types))
+	for k := range types {
+		columns = append(columns, k)
+	}
+	sort.Strings(columns)
+
+	header := []string{"gid:ID"}
+	for _, column := range columns {
+		header = append(header, column+":"+types[column])
+	}
+	header = append(header, ":LABEL")
+
+	rows := make([][]string, 0, len(items))
+	for _, item := range items {
+		row := []string{item["gid"].(string)}
+		for _, column := range columns {
+			row = append(row, csvValue(item[column]))
+		}
+		row = append(row, w.label)
+		rows = append(rows, row)
+	}
+
+	return writeCsv(fileName, header, rows)
+}
+
+// writeArgsFile writes a neo4j-admin argument file listing all files produced by the full sync.
+// Dataset nodes are listed before target stubs so that the labelled node wins when duplicates are skipped.
+func (w *BulkImportDatasetWriter) writeArgsFile() error {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return err
+	}
+
+	var nodes, targets, relationships []string
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(w.dir, name)
+		switch {
+		case !isBulkImportFile(name):
+			continue
+		case strings.HasPrefix(name, "nodes-"):
+			nodes = append(nodes, "--nodes="+path)
+		case strings.HasPrefix(name, "targets-"):
+			targets = append(targets, "--nodes="+path)
+		case strings.HasPrefix(name, "relationships-"):
+			relationships = append(relationships, "--relationships="+path)
+		}
+	}
+
+	lines := []string{"--skip-duplicate-nodes=true", "--multiline-fields=true"}
+	lines = append(lines, nodes...)
+	lines = append(lines, targets...)
+	lines = append(lines, relationships...)
+
+	return os.WriteFile(filepath.Join(w.dir, BulkImportArgsFile), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func writeCsv(fileName string, header []string, rows [][]string) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	err = writer.Write(header)
+	if err != nil {
+		return err
+	}
+	err = writer.WriteAll(rows)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// csvType returns the neo4j-admin import type of a property value
+func csvType(v any) string {
+	switch val := v.(type) {
+	case bool:
+		return "boolean"
+	case int, int32, int64:
+		return "long"
+	case float32, float64:
+		return "double"
+	case []any:
+		if len(val) == 0 {
+			return "string[]"
+		}
+		t := csvType(val[0])
+		for _, e := range val[1:] {
+			if csvType(e) != t {
+				return "string[]"
+			}
+		}
+		if strings.HasSuffix(t, "[]") {
+			return "string[]"
+		}
+		return t + "[]"
+	case []string:
+		return "string[]"
+	case []float64:
+		return "double[]"
+	default:
+		return "string"
+	}
+}
+
+// csvStringType picks the string type matching the shape of two conflicting column types
+func csvStringType(a string, b string) string {
+	if strings.HasSuffix(a, "[]") || strings.HasSuffix(b, "[]") {
+		return "string[]"
+	}
+	return "string"
+}
+
+// csvValue formats a property value, arrays use the default neo4j-admin array delimiter
+func csvValue(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case []any:
+		parts := make([]string, 0, len(val))
+		for _, e := range val {
+			parts = append(parts, csvValue(e))
+		}
+		return strings.Join(parts, ";")
+	case []string:
+		return strings.Join(val, ";")
+	case []float64:
+		parts := make([]string, 0, len(val))
+		for _, e := range val {
+			parts = append(parts, strconv.FormatFloat(e, 'f', -1, 64))
+		}
+		return strings.Join(parts, ";")
+	default:
+		return fmt.Sprint(val)
+	}
+}
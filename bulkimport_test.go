@@ -0,0 +1,120 @@
+package layer
+
+import (
+	"encoding/csv"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readCsv(t *testing.T, fileName string) [][]string {
+	file, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestBulkImportFullSync(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "people")
+	logger := cdl.NewLogger("test", "text", "info")
+
+	// first batch of the full sync
+	batch := cdl.BatchInfo{SyncId: "1", IsStartBatch: true}
+	writer, err := NewBulkImportDatasetWriter(dir, "people", "Person", 1, nil, batch, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layerErr := writer.Write(makeEntity("1"))
+	if layerErr != nil {
+		t.Error(layerErr)
+	}
+	layerErr = writer.Close()
+	if layerErr != nil {
+		t.Error(layerErr)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, BulkImportArgsFile)); err == nil {
+		t.Error("Expected no args file before the last batch")
+	}
+
+	// last batch of the full sync
+	batch = cdl.BatchInfo{SyncId: "1", IsLastBatch: true}
+	writer, err = NewBulkImportDatasetWriter(dir, "people", "Person", 10, nil, batch, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entity := makeEntity("2")
+	entity.SetProperty("http://data.sample.org/tags", []any{"a", "b"})
+	layerErr = writer.Write(entity)
+	if layerErr != nil {
+		t.Error(layerErr)
+	}
+	layerErr = writer.Close()
+	if layerErr != nil {
+		t.Error(layerErr)
+	}
+
+	nodes := readCsv(t, filepath.Join(dir, "nodes-000000.csv"))
+	if strings.Join(nodes[0], ",") != "gid:ID,age:long,name:string,source:string,:LABEL" {
+		t.Errorf("Unexpected node header %v", nodes[0])
+	}
+	if strings.Join(nodes[1], ",") != "http://data.sample.org/things/1,23,brian,people,Person" {
+		t.Errorf("Unexpected node row %v", nodes[1])
+	}
+
+	nodes = readCsv(t, filepath.Join(dir, "nodes-000001.csv"))
+	if strings.Join(nodes[0], ",") != "gid:ID,age:long,name:string,source:string,tags:string[],:LABEL" {
+		t.Errorf("Unexpected node header %v", nodes[0])
+	}
+	if nodes[1][4] != "a;b" {
+		t.Errorf("Expected array value a;b, got %s", nodes[1][4])
+	}
+
+	targets := readCsv(t, filepath.Join(dir, "targets-000000.csv"))
+	if len(targets) != 2 || targets[1][0] != "http://data.sample.org/things/mimiro" {
+		t.Errorf("Unexpected targets %v", targets)
+	}
+
+	relationships := readCsv(t, filepath.Join(dir, "relationships-000000.csv"))
+	if strings.Join(relationships[1], ",") != "http://data.sample.org/things/1,http://data.sample.org/things/mimiro,worksfor,people" {
+		t.Errorf("Unexpected relationship row %v", relationships[1])
+	}
+
+	args, err := os.ReadFile(filepath.Join(dir, BulkImportArgsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(args)), "\n")
+	if len(lines) != 8 {
+		t.Errorf("Expected 8 lines in args file, got %d", len(lines))
+	}
+	if lines[2] != "--nodes="+filepath.Join(dir, "nodes-000000.csv") || lines[4] != "--nodes="+filepath.Join(dir, "targets-000000.csv") {
+		t.Errorf("Expected dataset nodes before target nodes, got %v", lines)
+	}
+
+	// a new full sync removes the files of the previous one and leaves other files alone
+	err = os.WriteFile(filepath.Join(dir, "README.txt"), []byte("import files"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch = cdl.BatchInfo{SyncId: "2", IsStartBatch: true}
+	_, err = NewBulkImportDatasetWriter(dir, "people", "Person", 10, nil, batch, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "README.txt" {
+		t.Errorf("Expected only the unrelated file at start of full sync, found %v", entries)
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
 
 	cdl "github.com/mimiro-io/common-datalayer"
@@ -11,8 +14,76 @@ func main() {
 	// either pass in command argument or set DATALAYER_CONFIG_PATH environment variable.
 	configFolderLocation := ""
 	args := os.Args[1:]
+
+	// replay-dead-letters <dataset> [config folder] replays the dead letters of a dataset and exits
+	if len(args) >= 2 && args[0] == "replay-dead-letters" {
+		if len(args) >= 3 {
+			configFolderLocation = args[2]
+		}
+		os.Exit(replayDeadLetters(configFolderLocation, args[1]))
+	}
+
+	// health [config folder] checks the configured graphs and exits with 1 if any is unhealthy
+	if len(args) >= 1 && args[0] == "health" {
+		if len(args) >= 2 {
+			configFolderLocation = args[1]
+		}
+		os.Exit(checkHealth(configFolderLocation))
+	}
+
 	if len(args) >= 1 {
 		configFolderLocation = args[0]
 	}
 	cdl.NewServiceRunner(layer.NewOpenCypherDataLayer).WithConfigLocation(configFolderLocation).StartAndWait()
 }
+
+// startCommand starts the layer for a one-off command, without index changes or spool workers
+func startCommand(configFolderLocation string) (*cdl.ServiceRunner, *layer.OpenCypherDataLayer, error) {
+	serviceRunner := cdl.NewServiceRunner(layer.NewCommandDataLayer).WithConfigLocation(configFolderLocation)
+	// listen on a free port so the command can run next to a running layer
+	serviceRunner.WithEnrichConfig(func(config *cdl.Config) error {
+		config.LayerServiceConfig.Port = "0"
+		return nil
+	})
+	err := serviceRunner.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+	return serviceRunner, serviceRunner.LayerService().(*layer.OpenCypherDataLayer), nil
+}
+
+func replayDeadLetters(configFolderLocation string, dataset string) int {
+	serviceRunner, service, err := startCommand(configFolderLocation)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer serviceRunner.Stop()
+
+	count, err := service.ReplayDeadLetters(context.Background(), dataset)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay of dead letters for dataset %s failed: %s\n", dataset, err.Error())
+		return 1
+	}
+	fmt.Printf("replayed %d dead letters for dataset %s\n", count, dataset)
+	return 0
+}
+
+func checkHealth(configFolderLocation string) int {
+	serviceRunner, service, err := startCommand(configFolderLocation)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer serviceRunner.Stop()
+
+	exitCode := 0
+	for _, status := range service.CheckHealth(context.Background()) {
+		data, _ := json.Marshal(status)
+		fmt.Println(string(data))
+		if !status.Healthy {
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,147 @@
+package layer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labels, properties and index names are put into cypher statements as they are, so only plain identifiers are accepted
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// configProblems collects everything wrong with a config so it can be reported in one go
+type configProblems []string
+
+func (p *configProblems) add(format string, args ...any) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+// merge adds the problems of err, prefixed with the part of the config they were found in
+func (p *configProblems) merge(location string, err error) {
+	if err == nil {
+		return
+	}
+	var problems configProblems
+	if !errors.As(err, &problems) {
+		problems = configProblems{err.Error()}
+	}
+	for _, problem := range problems {
+		p.add("%s: %s", location, problem)
+	}
+}
+
+// err returns the problems as an error, or nil when there are none
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return p
+}
+
+func (p configProblems) Error() string {
+	return strings.Join(p, "; ")
+}
+
+// decodeConfig sets the fields of target from their json keys in config. Unlike json.Unmarshal it does not
+// stop at the first value of the wrong type, and keys that match no field are reported as well.
+func decodeConfig(config map[string]any, target any, problems *configProblems) {
+	decodeConfigKeys(config, reflect.ValueOf(target).Elem(), "", problems)
+}
+
+func decodeConfigKeys(config map[string]any, target reflect.Value, prefix string, problems *configProblems) {
+	fields := make(map[string]int)
+	for i := 0; i < target.NumField(); i++ {
+		name := strings.Split(target.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		i, ok := fields[key]
+		if !ok {
+			problems.add("unknown key %s%s", prefix, key)
+			continue
+		}
+		value := config[key]
+		if value == nil {
+			continue
+		}
+		field := target.Field(i)
+
+		// nested settings are checked key by key too
+		nested, isObject := value.(map[string]any)
+		if isObject && field.Kind() == reflect.Pointer && field.Type().Elem().Kind() == reflect.Struct {
+			field.Set(reflect.New(field.Type().Elem()))
+			decodeConfigKeys(nested, field.Elem(), prefix+key+".", problems)
+			continue
+		}
+
+		list, isList := value.([]any)
+		if isList && field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct {
+			field.Set(reflect.MakeSlice(field.Type(), len(list), len(list)))
+			for n, element := range list {
+				elementKey := fmt.Sprintf("%s%s[%d]", prefix, key, n)
+				elementConfig, ok := element.(map[string]any)
+				if !ok {
+					problems.add("%s must be an object", elementKey)
+					continue
+				}
+				decodeConfigKeys(elementConfig, field.Index(n), elementKey+".", problems)
+			}
+			continue
+		}
+
+		data, _ := json.Marshal(value)
+		if json.Unmarshal(data, field.Addr().Interface()) != nil {
+			problems.add("%s%s must be %s", prefix, key, typeDescription(field.Type()))
+		}
+	}
+}
+
+func typeDescription(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Int, reflect.Int64:
+		return "a whole number"
+	case reflect.Float64:
+		return "a number"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Slice:
+		return "a list"
+	default:
+		return "an object"
+	}
+}
+
+// checkIdentifier adds a problem when value cannot be used as a label, type, property or index name
+func checkIdentifier(key string, value string, problems *configProblems) {
+	if value == "" {
+		problems.add("no %s specified", key)
+	} else if !identifierPattern.MatchString(value) {
+		problems.add("%s '%s' must start with a letter or underscore and contain only letters, digits and underscores", key, value)
+	}
+}
+
+// hasConnectionKeys tells whether the root of system_config holds a connection, rather than only the
+// named connections in graphs and settings shared by all of them
+func hasConnectionKeys(nativeSystemConfig map[string]any) bool {
+	for key := range nativeSystemConfig {
+		if key != "graphs" && key != "tracing" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidation(t *testing.T) {
+	dl := &OpenCypherDataLayer{logger: cdl.NewLogger("test", "text", "info"), metrics: newTestMetrics()}
+	config := &cdl.Config{
+		NativeSystemConfig: map[string]any{"system_type": "neo4j", "endpoint": 7687, "username": "neo4j", "password": "secret", "max_retries": "many"},
+		DatasetDefinitions: []*cdl.DatasetDefinition{
+			{DatasetName: "people", SourceConfig: map[string]any{"label": "Person", "batch_size": 0}},
+			{DatasetName: "staff", SourceConfig: map[string]any{"label": "Person"}},
+			{DatasetName: "companies", SourceConfig: map[string]any{"label": "Company`) DETACH DELETE (n", "batchsize": 100}},
+			{DatasetName: "places", SourceConfig: map[string]any{"label": 42, "dead_letter": map[string]any{"type": "directory", "folder": "/tmp"}}},
+		},
+	}
+
+	err := dl.UpdateConfiguration(config)
+	if err == nil {
+		t.Fatal("Expected invalid configuration")
+	}
+	if err.Underlying() == nil || !strings.HasPrefix(err.Error(), "invalid configuration: ") {
+		t.Errorf("Unexpected error %s", err.Error())
+	}
+	expected := []string{
+		"system_config: endpoint must be a string",
+		"system_config: no endpoint specified",
+		"system_config: invalid retry settings: max_retries must be a non-negative number",
+		"dataset people: batch_size must be at least 1",
+		"dataset companies: unknown key batchsize",
+		"dataset companies: label 'Company`) DETACH DELETE (n' must start with a letter",
+		"dataset places: label must be a string",
+		"dataset places: unknown key dead_letter.folder",
+		"dataset places: no path specified for dead letter directory",
+	}
+	for _, problem := range expected {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected problem '%s' in %s", problem, err.Error())
+		}
+	}
+
+	// duplicates are only reported once the graph connection is valid
+	config.NativeSystemConfig = map[string]any{"system_type": "neo4j", "endpoint": "bolt://localhost:7687", "username": "neo4j", "password": "secret"}
+	config.DatasetDefinitions = config.DatasetDefinitions[:2]
+	config.DatasetDefinitions[0].SourceConfig["batch_size"] = 10
+	err = dl.UpdateConfiguration(config)
+	if err == nil || !strings.Contains(err.Error(), "dataset staff: label Person is already used by dataset people") {
+		t.Errorf("Expected duplicate label, got %v", err)
+	}
+
+	// datasets cannot share the folders they write files to
+	config.DatasetDefinitions = []*cdl.DatasetDefinition{
+		{DatasetName: "people", SourceConfig: map[string]any{"label": "Person", "full_sync_mode": "bulk_import", "bulk_import_dir": "/data/import"}},
+		{DatasetName: "places", SourceConfig: map[string]any{"label": "Place", "full_sync_mode": "bulk_import", "bulk_import_dir": "/data/import/"}},
+	}
+	err = dl.UpdateConfiguration(config)
+	if err == nil || !strings.Contains(err.Error(), "dataset places: bulk_import_dir /data/import is already used by dataset people") {
+		t.Errorf("Expected shared bulk import folder, got %v", err)
+	}
+	config.DatasetDefinitions[1].SourceConfig = map[string]any{"label": "Place", "spool_dir": "/data/spool"}
+	config.DatasetDefinitions = append(config.DatasetDefinitions, &cdl.DatasetDefinition{DatasetName: "companies", SourceConfig: map[string]any{"label": "Company", "spool_dir": "/data/spool"}})
+	err = dl.UpdateConfiguration(config)
+	if err == nil || !strings.Contains(err.Error(), "dataset companies: spool_dir /data/spool is already used by dataset places") {
+		t.Errorf("Expected shared spool folder, got %v", err)
+	}
+}
+
+func TestConfigUpdateKeepsDatasetsOnFailure(t *testing.T) {
+	api := &fakeQueryAPI{failOn: "EXPLAIN", failCode: "Neo.ClientError.Statement.SyntaxError"}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	dl := &OpenCypherDataLayer{logger: cdl.NewLogger("test", "text", "info"), metrics: newTestMetrics(), ctx: context.Background()}
+	running, err := NewGraphDataset("people", &fakeQueryClient{}, &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{"label": "Person"}}, dl.logger, dl.metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.datasets = map[string]*GraphDataset{"people": running}
+
+	config := &cdl.Config{
+		NativeSystemConfig: map[string]any{"system_type": "neo4j", "endpoint": server.URL, "username": "neo4j", "password": "secret"},
+		DatasetDefinitions: []*cdl.DatasetDefinition{
+			{DatasetName: "staff", SourceConfig: map[string]any{"label": "Staff", "write_templates": map[string]any{"update_node": "UNWIND $items AS item MERGE (n:Staff {gid: item.gid})"}}},
+		},
+	}
+	layerErr := dl.UpdateConfiguration(config)
+	if layerErr == nil || !strings.Contains(layerErr.Error(), "write_templates.update_node is not valid cypher") {
+		t.Fatalf("Expected invalid template, got %v", layerErr)
+	}
+	if _, layerErr = dl.Dataset("people"); layerErr != nil || running.stopped.Err() != nil {
+		t.Errorf("Expected the running dataset to be kept, got %v", layerErr)
+	}
+	if slices.ContainsFunc(api.statements, func(statement string) bool { return strings.Contains(statement, "CREATE") }) {
+		t.Errorf("Expected no index changes for a failing config, got %v", api.statements)
+	}
+
+	// templates that cannot be checked are not reported as invalid cypher
+	api.failCode = "Neo.ClientError.Security.Forbidden"
+	layerErr = dl.UpdateConfiguration(config)
+	if layerErr == nil || layerErr.Underlying() == nil || !strings.HasPrefix(layerErr.Error(), "could not check write_templates.update_node of dataset staff") {
+		t.Errorf("Expected the template check to fail, got %v", layerErr)
+	}
+
+	// a usable config replaces the running datasets, syncs running on them are not aborted
+	writer, layerErr := running.Incremental(context.Background())
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	api.failOn = ""
+	if layerErr = dl.UpdateConfiguration(config); layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	defer dl.datasets["staff"].Stop()
+	if _, layerErr = dl.Dataset("people"); layerErr == nil {
+		t.Error("Expected the previous dataset to be replaced")
+	}
+	if writer.(*CypherDatasetWriter).ctx.Err() != nil {
+		t.Error("Expected the running sync to keep its context")
+	}
+	_ = writer.Write(makeEntity("1"))
+	if layerErr = writer.Close(); layerErr != nil {
+		t.Errorf("Expected the running sync to finish, got %v", layerErr)
+	}
+	if _, layerErr = dl.Dataset("staff"); layerErr != nil {
+		t.Error(layerErr)
+	}
+	if !slices.Contains(api.statements, "CREATE INDEX external_id_index_Staff IF NOT EXISTS FOR (n:Staff) ON (n.gid)") {
+		t.Errorf("Expected the index of the new dataset, got %v", api.statements)
+	}
+}
+
+func TestCommandDataLayer(t *testing.T) {
+	api := &fakeQueryAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	spoolDir := t.TempDir()
+	leftover := filepath.Join(spoolDir, "batch-1.ndjson.tmp")
+	if err := os.WriteFile(leftover, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &cdl.Config{
+		NativeSystemConfig: map[string]any{"system_type": "neo4j", "endpoint": server.URL, "username": "neo4j", "password": "secret"},
+		DatasetDefinitions: []*cdl.DatasetDefinition{
+			{DatasetName: "people", SourceConfig: map[string]any{"label": "Person", "spool_dir": spoolDir}},
+		},
+	}
+	service, err := NewCommandDataLayer(config, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Stop(context.Background())
+
+	// the indexes and the spool are left to the running service
+	if len(api.statements) != 0 {
+		t.Errorf("Expected no statements before the command runs, got %v", api.statements)
+	}
+	if _, err = os.Stat(leftover); err != nil {
+		t.Errorf("Expected the spool worker not to be started, got %v", err)
+	}
+	statuses := service.(*OpenCypherDataLayer).CheckHealth(context.Background())
+	if len(statuses) != 1 || len(api.statements) == 0 {
+		t.Errorf("Expected the command to check the graph, got %v %v", statuses, api.statements)
+	}
+}
@@ -0,0 +1,267 @@
+package layer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DeadLetterTypeDirectory = "directory"
+	DeadLetterTypeGraph     = "graph"
+)
+
+// default label of dead letter nodes when the graph store is used
+const DefaultDeadLetterLabel = "DeadLetter"
+
+type DeadLetterConfig struct {
+	Type  string `json:"type"`  // directory or graph
+	Path  string `json:"path"`  // folder for ndjson files when type is directory
+	Label string `json:"label"` // node label when type is graph
+}
+
+// DeadLetter is an entity that could not be written to the graph. It marshals to an egdm entity
+// with the error details as additional fields, so dead letter files remain readable as entities.
+type DeadLetter struct {
+	*egdm.Entity
+	DeadLetterID string    `json:"deadLetterId"`
+	Error        string    `json:"error"`
+	SyncId       string    `json:"syncId,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+func NewDeadLetter(entity *egdm.Entity, err string, syncId string) *DeadLetter {
+	return &DeadLetter{Entity: entity, DeadLetterID: uuid.New().String(), Error: err, SyncId: syncId, Timestamp: time.Now().UTC()}
+}
+
+// DeadLetterStore keeps rejected entities until they are replayed
+type DeadLetterStore interface {
+	Store(ctx context.Context, letters []*DeadLetter) error
+	// Replay hands the stored dead letters to replay in batches, each batch is removed from the store
+	// once replay returns without error
+	Replay(ctx context.Context, replay func(letters []*DeadLetter) error) error
+}
+
+func NewDeadLetterStore(config *DeadLetterConfig, source string, queryClient GraphQueryClient) (DeadLetterStore, error) {
+	switch config.Type {
+	case DeadLetterTypeDirectory:
+		err := os.MkdirAll(config.Path, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return &directoryDeadLetterStore{dir: config.Path}, nil
+	case DeadLetterTypeGraph:
+		label := config.Label
+		if label == "" {
+			label = DefaultDeadLetterLabel
+		}
+		return &graphDeadLetterStore{queryClient: queryClient, source: source, label: label}, nil
+	default:
+		return nil, fmt.Errorf("unsupported dead letter type %s", config.Type)
+	}
+}
+
+// directoryDeadLetterStore writes each stored set of dead letters to its own ndjson file
+type directoryDeadLetterStore struct {
+	dir string
+}
+
+func (d *directoryDeadLetterStore) Store(ctx context.Context, letters []*DeadLetter) error {
+	fileName := filepath.Join(d.dir, fmt.Sprintf("deadletters-%d.ndjson", time.Now().UnixNano()))
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, letter := range letters {
+		err = encoder.Encode(letter)
+		if err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+func (d *directoryDeadLetterStore) Replay(ctx context.Context, replay func(letters []*DeadLetter) error) error {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+
+	// replay files in the order they were written, later ones may hold newer versions of an entity
+	fileNames := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".ndjson") {
+			fileNames = append(fileNames, entry.Name())
+		}
+	}
+	sort.Strings(fileNames)
+
+	for _, fileName := range fileNames {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		path := filepath.Join(d.dir, fileName)
+		letters, err := readDeadLetters(path)
+		if err != nil {
+			return err
+		}
+
+		err = replay(letters)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readDeadLetters(path string) ([]*DeadLetter, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	letters := make([]*DeadLetter, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		letter := &DeadLetter{}
+		err = json.Unmarshal(scanner.Bytes(), letter)
+		if err != nil {
+			return nil, fmt.Errorf("could not read dead letter in %s because %s", path, err.Error())
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+// graphDeadLetterStore keeps dead letters as nodes with a dedicated label in the dataset's graph
+type graphDeadLetterStore struct {
+	queryClient GraphQueryClient
+	source      string
+	label       string
+}
+
+func (g *graphDeadLetterStore) Store(ctx context.Context, letters []*DeadLetter) error {
+	return g.queryClient.StoreDeadLetters(ctx, g.source, g.label, letters)
+}
+
+func (g *graphDeadLetterStore) Replay(ctx context.Context, replay func(letters []*DeadLetter) error) error {
+	letters, err := g.queryClient.DeadLetters(ctx, g.source, g.label)
+	if err != nil {
+		return err
+	}
+	if len(letters) == 0 {
+		return nil
+	}
+
+	err = replay(letters)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(letters))
+	for _, letter := range letters {
+		ids = append(ids, letter.DeadLetterID)
+	}
+	return g.queryClient.DeleteDeadLetters(ctx, g.source, g.label, ids)
+}
+
+const StoreDeadLettersTemplate = `
+UNWIND $items AS item
+CREATE (d:%s)
+SET d = item
+`
+
+const DeadLettersQueryTemplate = `
+MATCH (d:%s {source: $source})
+RETURN d.deadLetterId AS deadLetterId, d.entity AS entity, d.error AS error, d.syncId AS syncId, d.timestamp AS timestamp
+ORDER BY d.timestamp
+`
+
+const DeleteDeadLettersTemplate = `
+UNWIND $ids AS id
+MATCH (d:%s {deadLetterId: id})
+DELETE d
+`
+
+// StoreDeadLetters creates a node per dead letter holding the entity as json. The nodes have no gid
+// so they never match the dataset's own nodes.
+func (n *Neo4jClient) StoreDeadLetters(ctx context.Context, source string, label string, letters []*DeadLetter) error {
+	n.logger.Info("storing dead letters", "source", source, "label", label, "entities", len(letters))
+	items := make([]map[string]any, 0, len(letters))
+	for _, letter := range letters {
+		entity, err := json.Marshal(letter.Entity)
+		if err != nil {
+			return err
+		}
+		items = append(items, map[string]any{
+			"deadLetterId": letter.DeadLetterID,
+			"source":       source,
+			"entityId":     letter.ID,
+			"entity":       string(entity),
+			"error":        letter.Error,
+			"syncId":       letter.SyncId,
+			"timestamp":    letter.Timestamp.Format(time.RFC3339Nano),
+		})
+	}
+
+	return n.ExecuteWrite(ctx, source, 0, func(txn CypherTransaction) error {
+		return txn.Run(ctx, fmt.Sprintf(StoreDeadLettersTemplate, label), map[string]any{"items": items})
+	})
+}
+
+func (n *Neo4jClient) DeadLetters(ctx context.Context, source string, label string) ([]*DeadLetter, error) {
+	transport, err := n.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer transport.Close(ctx)
+
+	rows, err := transport.Collect(ctx, fmt.Sprintf(DeadLettersQueryTemplate, label), map[string]any{"source": source})
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*DeadLetter, 0, len(rows))
+	for _, row := range rows {
+		letter := &DeadLetter{Entity: egdm.NewEntity()}
+		entity, _ := row["entity"].(string)
+		err = json.Unmarshal([]byte(entity), letter.Entity)
+		if err != nil {
+			return nil, fmt.Errorf("could not read dead letter entity because %s", err.Error())
+		}
+		letter.DeadLetterID, _ = row["deadLetterId"].(string)
+		letter.Error, _ = row["error"].(string)
+		letter.SyncId, _ = row["syncId"].(string)
+		timestamp, _ := row["timestamp"].(string)
+		letter.Timestamp, _ = time.Parse(time.RFC3339Nano, timestamp)
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+func (n *Neo4jClient) DeleteDeadLetters(ctx context.Context, source string, label string, ids []string) error {
+	return n.ExecuteWrite(ctx, source, 0, func(txn CypherTransaction) error {
+		return txn.Run(ctx, fmt.Sprintf(DeleteDeadLettersTemplate, label), map[string]any{"ids": ids})
+	})
+}
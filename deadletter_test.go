@@ -0,0 +1,76 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"os"
+	"testing"
+)
+
+func TestDeadLettersAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	client := &fakeQueryClient{poison: map[string]bool{"http://data.sample.org/things/2": true}}
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{
+		"label":       "Person",
+		"batch_size":  10,
+		"dead_letter": map[string]any{"type": "directory", "path": dir},
+	}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, layerErr := ds.FullSync(context.Background(), cdl.BatchInfo{SyncId: "s1", IsStartBatch: true, IsLastBatch: true})
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		writer.Write(makeEntity(id))
+	}
+	layerErr = writer.Close()
+	if layerErr != nil {
+		t.Fatalf("Expected rejected entity to be dead lettered, got %s", layerErr.Error())
+	}
+	if len(client.written) != 2 {
+		t.Errorf("Expected 2 entities written, got %d", len(client.written))
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 dead letter file, got %d", len(entries))
+	}
+	letters, err := readDeadLetters(dir + "/" + entries[0].Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].ID != "http://data.sample.org/things/2" || letters[0].SyncId != "s1" || letters[0].Error == "" {
+		t.Errorf("Unexpected dead letters %v", letters)
+	}
+
+	// replaying while the entity is still rejected keeps it as a dead letter
+	count, err := ds.ReplayDeadLetters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 replayed entity, got %d", count)
+	}
+	entries, _ = os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected entity to be dead lettered again, got %d files", len(entries))
+	}
+
+	// once fixed the replay writes the entity and empties the store
+	client.poison = nil
+	_, err = ds.ReplayDeadLetters(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ = os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Expected no dead letters after replay, got %d files", len(entries))
+	}
+	if len(client.written) != 3 || client.written[2].ID != "http://data.sample.org/things/2" {
+		t.Errorf("Expected replayed entity to be written")
+	}
+}
@@ -0,0 +1,137 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HealthStatus is the result of checking a graph database the layer writes to
+type HealthStatus struct {
+	Graph          string    `json:"graph"`
+	Database       string    `json:"database,omitempty"`
+	Healthy        bool      `json:"healthy"`
+	ServerVersion  string    `json:"serverVersion,omitempty"`
+	Edition        string    `json:"edition,omitempty"`
+	MissingIndexes []string  `json:"missingIndexes,omitempty"` // labels without an index on gid and names of missing declared indexes and constraints
+	Error          string    `json:"error,omitempty"`
+	Checked        time.Time `json:"checked"`
+}
+
+const ComponentsQuery = "CALL dbms.components() YIELD versions, edition RETURN versions[0] AS version, edition"
+
+const MemgraphVersionQuery = "SHOW VERSION"
+
+const IndexesQuery = "SHOW INDEXES YIELD name, labelsOrTypes, properties RETURN name, labelsOrTypes, properties"
+
+const MemgraphIndexesQuery = "SHOW INDEX INFO"
+
+// CheckHealth connects and authenticates to the database, reads the server version and edition and
+// verifies that each of the labels has an index on gid and that the declared indexes and constraints exist
+func (n *Neo4jClient) CheckHealth(ctx context.Context, schemas []LabelSchema) *HealthStatus {
+	graph := n.graph
+	if graph == "" {
+		graph = "default"
+	}
+	status := &HealthStatus{Graph: graph, Database: n.database, Checked: time.Now().UTC()}
+
+	err := n.checkHealth(ctx, schemas, status)
+	if err != nil {
+		status.Error = fmt.Sprintf("%s error: %s", errorCategory(err), err.Error())
+		return status
+	}
+	status.Healthy = len(status.MissingIndexes) == 0
+	return status
+}
+
+func (n *Neo4jClient) checkHealth(ctx context.Context, schemas []LabelSchema, status *HealthStatus) error {
+	transport, err := n.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer transport.Close(ctx)
+
+	versionQuery, indexesQuery := ComponentsQuery, IndexesQuery
+	if n.systemType == SystemTypeMemgraph {
+		versionQuery, indexesQuery = MemgraphVersionQuery, MemgraphIndexesQuery
+	}
+
+	rows, err := transport.Collect(ctx, versionQuery, nil)
+	if err != nil {
+		return err
+	}
+	if len(rows) > 0 {
+		status.ServerVersion, _ = rows[0]["version"].(string)
+		status.Edition, _ = rows[0]["edition"].(string)
+	}
+	if n.systemType == SystemTypeMemgraph {
+		status.Edition = SystemTypeMemgraph
+	}
+
+	rows, err = transport.Collect(ctx, indexesQuery, nil)
+	if err != nil {
+		return err
+	}
+	indexed := make(map[string]bool) // by label and properties joined with commas
+	names := make(map[string]bool)   // indexes and constraints by name, memgraph has no names
+	for _, row := range rows {
+		if n.systemType == SystemTypeMemgraph {
+			label, _ := row["label"].(string)
+			// a string in older memgraph versions, a list in newer ones
+			properties := stringList(row["property"])
+			if property, ok := row["property"].(string); ok {
+				properties = []string{property}
+			}
+			indexed[label+":"+strings.Join(properties, ",")] = true
+			continue
+		}
+		properties := stringList(row["properties"])
+		for _, label := range stringList(row["labelsOrTypes"]) {
+			indexed[label+":"+strings.Join(properties, ",")] = true
+		}
+		name, _ := row["name"].(string)
+		names[name] = true
+	}
+
+	declared := slices.ContainsFunc(schemas, func(schema LabelSchema) bool { return len(schema.Indexes) > 0 })
+	if declared && n.systemType != SystemTypeMemgraph {
+		// exists constraints have no index
+		rows, err = transport.Collect(ctx, ShowConstraintsQuery, nil)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			name, _ := row["name"].(string)
+			names[name] = true
+		}
+	}
+
+	for _, schema := range schemas {
+		if !indexed[schema.Label+":gid"] {
+			status.MissingIndexes = append(status.MissingIndexes, schema.Label)
+		}
+		for _, index := range schema.Indexes {
+			if n.systemType == SystemTypeMemgraph && !indexed[schema.Label+":"+strings.Join(index.Properties, ",")] ||
+				n.systemType != SystemTypeMemgraph && !names[index.indexName(schema.Label)] {
+				status.MissingIndexes = append(status.MissingIndexes, index.indexName(schema.Label))
+			}
+		}
+	}
+	sort.Strings(status.MissingIndexes)
+	return nil
+}
+
+// stringList reads a list of strings returned by either transport
+func stringList(v any) []string {
+	values, _ := v.([]any)
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
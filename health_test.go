@@ -0,0 +1,75 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckHealth(t *testing.T) {
+	api := &fakeQueryAPI{results: map[string]string{
+		"dbms.components":  `{"fields":["version","edition"],"values":[["5.26.0","enterprise"]]}`,
+		"SHOW INDEXES":     `{"fields":["name","labelsOrTypes","properties"],"values":[["external_id_index_Person",["Person"],["gid"]],["Company_range_name",["Company"],["name"]],["index_lookup",null,null]]}`,
+		"SHOW CONSTRAINTS": `{"fields":["name","entityType","labelsOrTypes"],"values":[["Person_exists_email","NODE",["Person"]]]}`,
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewNeo4jClient(server.URL, "graph1", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics()).WithGraph("analytics")
+	person := LabelSchema{Label: "Person", Indexes: []IndexConfig{{Type: IndexTypeExists, Properties: []string{"email"}}}}
+	status := client.CheckHealth(context.Background(), []LabelSchema{person})
+	if !status.Healthy || status.ServerVersion != "5.26.0" || status.Edition != "enterprise" || status.Graph != "analytics" || status.Database != "graph1" {
+		t.Errorf("Unexpected health %+v", status)
+	}
+
+	status = client.CheckHealth(context.Background(), []LabelSchema{person, {Label: "Company"}})
+	if status.Healthy || len(status.MissingIndexes) != 1 || status.MissingIndexes[0] != "Company" {
+		t.Errorf("Expected missing index for Company, got %+v", status)
+	}
+
+	// declared indexes and constraints are checked by name
+	person.Indexes = append(person.Indexes, IndexConfig{Type: IndexTypeText, Properties: []string{"name"}})
+	status = client.CheckHealth(context.Background(), []LabelSchema{person})
+	if status.Healthy || len(status.MissingIndexes) != 1 || status.MissingIndexes[0] != "Person_text_name" {
+		t.Errorf("Expected missing declared index Person_text_name, got %+v", status)
+	}
+
+	client = NewNeo4jClient(server.URL, "graph1", Credentials{Username: "neo4j", Password: "wrong"}, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	status = client.CheckHealth(context.Background(), []LabelSchema{person})
+	if status.Healthy || !strings.HasPrefix(status.Error, "client error: ") || !strings.Contains(status.Error, "Unauthorized") {
+		t.Errorf("Expected authentication failure, got %+v", status)
+	}
+}
+
+func TestHealthCheckedPeriodically(t *testing.T) {
+	client := &fakeQueryClient{}
+	target := graphTarget{}
+	dl := &OpenCypherDataLayer{logger: cdl.NewLogger("test", "text", "info"), metrics: newTestMetrics(),
+		queryClients: map[graphTarget]GraphQueryClient{target: client}, targets: map[string]graphTarget{"people": target}}
+	dl.ctx, dl.cancel = context.WithCancel(context.Background())
+	defer dl.cancel()
+	var err error
+	dl.datasets = make(map[string]*GraphDataset)
+	dl.datasets["people"], err = NewGraphDataset("people", client, &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{"label": "Person"}}, dl.logger, dl.metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl.CheckHealth(dl.ctx)
+	go dl.checkHealthPeriodically(time.Millisecond)
+
+	// a graph going down after startup shows in the descriptions without a config change
+	client.lock.Lock()
+	client.unavailable = true
+	client.lock.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if health := dl.DatasetDescriptions()[0].Metadata["health"].(*HealthStatus); !health.Healthy {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Error("Expected the periodic check to report the graph as unhealthy")
+}
@@ -0,0 +1,51 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+)
+
+// HooksConfig holds cypher statements run around the syncs of a dataset. Each statement runs in its own
+// write transaction with the parameters $dataset, $label and $syncId, which is null for incremental syncs.
+type HooksConfig struct {
+	BeforeFullSync   []string `json:"before_full_sync"`  // run with the start batch, before the dataset is cleared
+	AfterFullSync    []string `json:"after_full_sync"`   // run once the last batch is written
+	AfterIncremental []string `json:"after_incremental"` // run once the batches of an incremental sync are written
+}
+
+// ExecuteStatement runs a statement in a write transaction of its own, retrying transient failures
+func (n *Neo4jClient) ExecuteStatement(ctx context.Context, source string, statement string, params map[string]any, options WriteOptions) (WriteStats, error) {
+	var stats WriteStats
+	err := n.ExecuteWrite(ctx, source, options.TransactionTimeout, func(txn CypherTransaction) error {
+		ctx, span := n.startStatementSpan(ctx, "hook", 0)
+		err := txn.Run(ctx, statement, params)
+		endSpan(span, err)
+		stats = txn.Stats()
+		return err
+	})
+	if err != nil {
+		return WriteStats{}, err
+	}
+	stats.emit(n.metrics, n.tags(source))
+	return stats, nil
+}
+
+// runHooks runs the statements in order and stops at the first failure, returning the changes made so far
+func (f *GraphDataset) runHooks(ctx context.Context, kind string, statements []string, syncId string) (WriteStats, error) {
+	params := map[string]any{"dataset": f.name, "label": f.config.Label, "syncId": nil}
+	if syncId != "" {
+		params["syncId"] = syncId
+	}
+
+	var stats WriteStats
+	for i, statement := range statements {
+		f.logger.Info(fmt.Sprintf("running %s hook %d for dataset %s", kind, i+1, f.name))
+		statementStats, err := f.queryClient.ExecuteStatement(ctx, f.name, statement, params, f.config.WriteOptions())
+		stats.Add(statementStats)
+		if err != nil {
+			f.metrics.Incr("opencypher.hook.errors", append(f.tags, "hook:"+kind), 1)
+			return stats, fmt.Errorf("%s hook %d failed because %s", kind, i+1, err.Error())
+		}
+	}
+	return stats, nil
+}
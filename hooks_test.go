@@ -0,0 +1,107 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestHooksAroundSyncs(t *testing.T) {
+	client := &fakeQueryClient{}
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{
+		"label": "Person",
+		"hooks": map[string]any{
+			"before_full_sync":  []any{"MATCH (n:Person) SET n:Stale"},
+			"after_full_sync":   []any{"MATCH (n:Stale) DETACH DELETE n"},
+			"after_incremental": []any{"CALL refresh($dataset, $label)"},
+		},
+	}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, batch := range []cdl.BatchInfo{{SyncId: "s1", IsStartBatch: true}, {SyncId: "s1"}, {SyncId: "s1", IsLastBatch: true}} {
+		writer, layerErr := ds.FullSync(context.Background(), batch)
+		if layerErr != nil {
+			t.Fatal(layerErr)
+		}
+		_ = writer.Write(makeEntity("1"))
+		if layerErr = writer.Close(); layerErr != nil {
+			t.Fatal(layerErr)
+		}
+	}
+	expected := []string{"MATCH (n:Person) SET n:Stale", "MATCH (n:Stale) DETACH DELETE n"}
+	if !slices.Equal(client.statements, expected) {
+		t.Errorf("Unexpected full sync hooks %v", client.statements)
+	}
+	if client.params["dataset"] != "people" || client.params["label"] != "Person" || client.params["syncId"] != "s1" {
+		t.Errorf("Unexpected hook parameters %v", client.params)
+	}
+
+	writer, layerErr := ds.Incremental(context.Background())
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	_ = writer.Write(makeEntity("2"))
+	if layerErr = writer.Close(); layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	if client.statements[len(client.statements)-1] != "CALL refresh($dataset, $label)" || client.params["syncId"] != nil {
+		t.Errorf("Expected the incremental hook without sync id, got %v %v", client.statements, client.params)
+	}
+
+	// a failing hook fails the sync and is reported on it
+	client.failOn = "SET n:Stale"
+	_, layerErr = ds.FullSync(context.Background(), cdl.BatchInfo{SyncId: "s2", IsStartBatch: true})
+	if layerErr == nil || !strings.HasPrefix(layerErr.Error(), "before_full_sync hook 1 failed because") {
+		t.Errorf("Expected failing hook, got %v", layerErr)
+	}
+	lastSync := ds.MetaData()["lastSync"].(SyncStats)
+	if lastSync.SyncId != "s2" || !strings.HasPrefix(lastSync.Error, "before_full_sync hook 1 failed") {
+		t.Errorf("Expected the hook failure on the last sync, got %+v", lastSync)
+	}
+
+	client.failOn = "refresh"
+	writer, _ = ds.Incremental(context.Background())
+	_ = writer.Write(makeEntity("3"))
+	layerErr = writer.Close()
+	if layerErr == nil || !strings.HasPrefix(layerErr.Error(), "after_incremental hook 1 failed because") {
+		t.Errorf("Expected failing incremental hook, got %v", layerErr)
+	}
+	if lastSync = ds.MetaData()["lastSync"].(SyncStats); lastSync.Error == "" || lastSync.Entities != 1 {
+		t.Errorf("Expected the written entity and the hook failure on the last sync, got %+v", lastSync)
+	}
+
+	// with a spool the batch is removed once written, a failing hook is only reported
+	spooled := &fakeQueryClient{failOn: "refresh"}
+	definition.SourceConfig["spool_dir"] = t.TempDir()
+	definition.SourceConfig["spool_retry_interval"] = "1h"
+	ds, err = NewGraphDataset("people", spooled, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Stop()
+	writer, _ = ds.Incremental(context.Background())
+	_ = writer.Write(makeEntity("4"))
+	if layerErr = writer.Close(); layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	if err = ds.spool.Drain(context.Background()); err != nil {
+		t.Errorf("Expected the drain to succeed despite the failing hook, got %v", err)
+	}
+	batches, _ := ds.spool.batches()
+	if len(batches) != 0 || len(spooled.written) != 1 {
+		t.Errorf("Expected the batch written once and removed, got %d written and %d spooled", len(spooled.written), len(batches))
+	}
+	if lastSync = ds.MetaData()["lastSync"].(SyncStats); !strings.HasPrefix(lastSync.Error, "after_incremental hook 1 failed") {
+		t.Errorf("Expected the hook failure on the last sync, got %+v", lastSync)
+	}
+
+	_, err = NewGraphDatasetConfig(map[string]any{"label": "Person", "full_sync_mode": "bulk_import", "hooks": map[string]any{"before_full_sync": []any{" "}}})
+	if err == nil || !strings.Contains(err.Error(), "hooks.before_full_sync[0] is empty; full sync hooks are not run in full sync mode bulk_import") {
+		t.Errorf("Unexpected validation %v", err)
+	}
+}
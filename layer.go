@@ -6,120 +6,460 @@ import (
 	"fmt"
 	cdl "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 type OpenCypherDataLayer struct {
-	config      *cdl.Config
-	logger      cdl.Logger
-	metrics     cdl.Metrics
-	datasets    map[string]*GraphDataset
-	graphSystem *GraphSystemConfig
+	config         *cdl.Config
+	logger         cdl.Logger
+	metrics        cdl.Metrics
+	datasets       map[string]*GraphDataset
+	graphSystems   map[string]*GraphSystemConfig // named graph connections, the root of system_config has the empty name
+	ctx            context.Context               // cancelled when the layer stops
+	cancel         context.CancelFunc
+	tracerProvider *sdktrace.TracerProvider // set when tracing is configured
+	targets        map[string]graphTarget   // graph database of each dataset
+	healthLock     sync.Mutex               // guards the fields below, the health check runs in the background
+	queryClients   map[graphTarget]GraphQueryClient
+	schemas        map[graphTarget][]LabelSchema // labels and declared indexes of each graph database
+	health         map[graphTarget]*HealthStatus // results of the last health check
+	command        bool                          // set for one-off commands, which leave indexes and spools to the service
 }
 
+// GraphQueryClient runs the layer's operations against a graph database. Every call stops the database
+// work when ctx is cancelled or its deadline passes.
 type GraphQueryClient interface {
-	Initialise(datasets []string) error
-	DeleteAll(source string, label string) error
-	WriteBatch(source string, label string, entities []*egdm.Entity) error
-	Query(query string) (interface{}, error)
+	Initialise(ctx context.Context, schemas []LabelSchema) error
+	DeleteAll(ctx context.Context, source string, label string, options WriteOptions) error
+	WriteBatch(ctx context.Context, source string, label string, entities []*egdm.Entity, options WriteOptions) (WriteStats, error)
+	StoreDeadLetters(ctx context.Context, source string, label string, letters []*DeadLetter) error
+	DeadLetters(ctx context.Context, source string, label string) ([]*DeadLetter, error)
+	DeleteDeadLetters(ctx context.Context, source string, label string, ids []string) error
+	Query(ctx context.Context, query string, params map[string]any) ([]map[string]any, error)
+	CheckHealth(ctx context.Context, schemas []LabelSchema) *HealthStatus
+	ExecuteStatement(ctx context.Context, source string, statement string, params map[string]any, options WriteOptions) (WriteStats, error)
+	Explain(ctx context.Context, statement string) error
 }
 
+// WriteOptions are the per dataset limits of write transactions
+type WriteOptions struct {
+	TransactionTimeout           time.Duration   // server side timeout of a write transaction, 0 for the server default
+	MaxRelationshipsPerStatement int             // relationships of one type per statement, 0 for no limit
+	DeleteChunkSize              int             // nodes or relationships removed per transaction when deleting a dataset, 0 for the default
+	Vectors                      map[string]int  // dimensions of the embedding properties of vector indexes, by local property name
+	Templates                    *WriteTemplates // statements replacing the default node, relationship and delete statements
+}
+
+const (
+	SystemTypeNeo4j    = "neo4j"
+	SystemTypeMemgraph = "memgraph"
+)
+
 // GrahSystemConfig is the config for connecting to the graph database
 type GraphSystemConfig struct {
-	systemType string
-	endpoint   string
-	userName   string
-	password   string
+	name        string
+	systemType  string
+	endpoint    string
+	credentials Credentials
+	tls         *TLSConfig
+	database    string // default database for datasets that do not specify one
+	retry       RetryPolicy
 }
 
 func NewOpenCypherDataLayer(conf *cdl.Config, logger cdl.Logger, metrics cdl.Metrics) (cdl.DataLayerService, error) {
-	datalayer := &OpenCypherDataLayer{config: conf, logger: logger, metrics: metrics}
+	return newOpenCypherDataLayer(&OpenCypherDataLayer{config: conf, logger: logger, metrics: metrics})
+}
+
+// NewCommandDataLayer creates the layer for one-off commands such as health and replay-dead-letters.
+// It neither changes the indexes of the graphs nor starts spool workers, so it can run next to the
+// service without competing with it.
+func NewCommandDataLayer(conf *cdl.Config, logger cdl.Logger, metrics cdl.Metrics) (cdl.DataLayerService, error) {
+	return newOpenCypherDataLayer(&OpenCypherDataLayer{config: conf, logger: logger, metrics: metrics, command: true})
+}
+
+func newOpenCypherDataLayer(datalayer *OpenCypherDataLayer) (cdl.DataLayerService, error) {
+	conf := datalayer.config
+	datalayer.ctx, datalayer.cancel = context.WithCancel(context.Background())
+
+	if conf.NativeSystemConfig["tracing"] != nil {
+		tracingConfig := &TracingConfig{}
+		data, _ := json.Marshal(conf.NativeSystemConfig["tracing"])
+		err := json.Unmarshal(data, tracingConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tracing config: %s", err.Error())
+		}
+		datalayer.tracerProvider, err = NewTracerProvider(tracingConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up tracing because %s", err.Error())
+		}
+	}
 
 	err := datalayer.UpdateConfiguration(conf)
 	if err != nil {
 		return nil, err
 	}
+	if !datalayer.command {
+		go datalayer.checkHealthPeriodically(HealthCheckInterval)
+	}
 
 	return datalayer, nil
 }
 
-func (dl *OpenCypherDataLayer) NewGraphQueryClient() (GraphQueryClient, error) {
-	if dl.graphSystem.systemType == "neo4j" {
-		client := NewNeo4jClient(dl.graphSystem.endpoint, dl.graphSystem.userName, dl.graphSystem.password, dl.logger)
+// graphSystemSettings are the keys of a graph connection in system_config
+type graphSystemSettings struct {
+	SystemType        string         `json:"system_type"`
+	Endpoint          string         `json:"endpoint"`
+	Username          string         `json:"username"` // ${NAME} is replaced by the environment variable NAME
+	Password          string         `json:"password"`
+	UsernameFile      string         `json:"username_file"` // file holding the username, such as a mounted secret
+	PasswordFile      string         `json:"password_file"`
+	AuthScheme        string         `json:"auth_scheme"` // basic (default), bearer, kerberos or none
+	Realm             string         `json:"realm"`
+	Token             string         `json:"token"` // bearer token or kerberos ticket
+	TokenFile         string         `json:"token_file"`
+	Database          string         `json:"database"`
+	MaxRetries        any            `json:"max_retries"` // the retry settings are checked by NewRetryPolicy
+	RetryInitialDelay any            `json:"retry_initial_delay"`
+	RetryMaxDelay     any            `json:"retry_max_delay"`
+	RetryMaxTime      any            `json:"retry_max_time"`
+	TLS               *TLSConfig     `json:"tls"`
+	Graphs            map[string]any `json:"graphs"`  // named connections, only at the root of system_config
+	Tracing           *TracingConfig `json:"tracing"` // only at the root of system_config
+}
+
+// NewGraphSystemConfig reads the connection details of a graph system, name is empty for the root of system_config.
+// All problems found are returned together.
+func NewGraphSystemConfig(name string, nativeSystemConfig map[string]any) (*GraphSystemConfig, error) {
+	problems := configProblems{}
+	settings := &graphSystemSettings{}
+	decodeConfig(nativeSystemConfig, settings, &problems)
 
-		datasetNames := make([]string, 0, len(dl.config.DatasetDefinitions))
-		for _, dataset := range dl.config.DatasetDefinitions {
-			sourceConfig := dataset.SourceConfig
-			label := sourceConfig["label"].(string)
-			datasetNames = append(datasetNames, label)
+	switch {
+	case settings.SystemType == "":
+		problems.add("no system_type specified")
+	case settings.SystemType != SystemTypeNeo4j && settings.SystemType != SystemTypeMemgraph:
+		problems.add("unsupported system_type %s, must be %s or %s", settings.SystemType, SystemTypeNeo4j, SystemTypeMemgraph)
+	case settings.SystemType == SystemTypeMemgraph && settings.Database != "":
+		problems.add("memgraph does not support selecting database %s", settings.Database)
+	}
+	if settings.Endpoint == "" {
+		problems.add("no endpoint specified")
+	}
+	credentials := Credentials{
+		Scheme:       settings.AuthScheme,
+		Username:     settings.Username,
+		Password:     settings.Password,
+		UsernameFile: settings.UsernameFile,
+		PasswordFile: settings.PasswordFile,
+		Realm:        settings.Realm,
+		Token:        settings.Token,
+		TokenFile:    settings.TokenFile,
+	}
+	checkCredentials(credentials, isHTTPEndpoint(settings.Endpoint), &problems)
+	if settings.TLS != nil {
+		if !isEncryptedEndpoint(settings.Endpoint) {
+			problems.add("tls needs an encrypted endpoint such as bolt+s://, neo4j+s:// or https://")
 		}
+		if (settings.TLS.CertFile == "") != (settings.TLS.KeyFile == "") {
+			problems.add("tls.cert_file and tls.key_file must be specified together")
+		} else if _, err := settings.TLS.Load(); err != nil {
+			problems.add("invalid tls settings: %s", err.Error())
+		}
+	}
+	if name != "" {
+		for _, key := range []string{"graphs", "tracing"} {
+			if nativeSystemConfig[key] != nil {
+				problems.add("%s is only allowed at the root of system_config", key)
+			}
+		}
+	}
 
-		err := client.Initialise(datasetNames)
-		if err != nil {
-			return nil, err
+	retry, err := NewRetryPolicy(nativeSystemConfig)
+	if err != nil {
+		problems.add("invalid retry settings: %s", err.Error())
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return &GraphSystemConfig{
+		name:        name,
+		systemType:  settings.SystemType,
+		endpoint:    settings.Endpoint,
+		credentials: credentials,
+		tls:         settings.TLS,
+		database:    settings.Database,
+		retry:       retry,
+	}, nil
+}
+
+// NewGraphQueryClient creates a client for the given graph system and database
+func (dl *OpenCypherDataLayer) NewGraphQueryClient(graphSystem *GraphSystemConfig, database string) (GraphQueryClient, error) {
+	var client *Neo4jClient
+	switch graphSystem.systemType {
+	case SystemTypeNeo4j:
+		client = NewNeo4jClient(graphSystem.endpoint, database, graphSystem.credentials, dl.logger, dl.metrics)
+	case SystemTypeMemgraph:
+		if database != "" {
+			return nil, fmt.Errorf("memgraph does not support selecting database %s", database)
 		}
-		return client, nil
-	} else {
-		return nil, fmt.Errorf("unsupported system type %s", dl.graphSystem.systemType)
+		client = NewMemgraphClient(graphSystem.endpoint, graphSystem.credentials, dl.logger, dl.metrics)
+	default:
+		return nil, fmt.Errorf("unsupported system type %s", graphSystem.systemType)
 	}
+
+	client.WithTLS(graphSystem.tls).WithRetryPolicy(graphSystem.retry).WithGraph(graphSystem.name)
+	return client, nil
+}
+
+// metricTags tags metrics with the dataset and the name of the graph system it is stored in
+func metricTags(dataset string, graph string) []string {
+	if graph == "" {
+		graph = "default"
+	}
+	return []string{"dataset:" + dataset, "graph:" + graph}
+}
+
+// graphTarget identifies a database in one of the configured graph systems
+type graphTarget struct {
+	graph    string
+	database string
 }
 
 func (dl *OpenCypherDataLayer) Stop(ctx context.Context) error {
-	// noop
+	dl.cancel()
+	for _, dataset := range dl.datasets {
+		dataset.Stop()
+	}
+	if dl.tracerProvider != nil {
+		// flushes the spans not yet exported
+		return dl.tracerProvider.Shutdown(ctx)
+	}
 	return nil
 }
 
 func (dl *OpenCypherDataLayer) UpdateConfiguration(config *cdl.Config) cdl.LayerError {
-	dl.config = config
-	dl.datasets = make(map[string]*GraphDataset)
-
-	// get connection details from native system
+	// get connection details from native system, the root holds the default connection
+	// and graphs holds additional named connections. All problems in the config are
+	// collected and reported together.
+	problems := configProblems{}
 	nativeSystemConfig := config.NativeSystemConfig
-	graphSystem := &GraphSystemConfig{}
+	graphSystems := make(map[string]*GraphSystemConfig)
 
-	if nativeSystemConfig["system_type"] != nil {
-		graphSystem.systemType = nativeSystemConfig["system_type"].(string)
-	} else {
-		return cdl.Err(fmt.Errorf("no system type specified in native system config"), cdl.LayerErrorBadParameter)
+	graphs, hasGraphs := nativeSystemConfig["graphs"]
+	if !hasGraphs || hasConnectionKeys(nativeSystemConfig) {
+		graphSystem, err := NewGraphSystemConfig("", nativeSystemConfig)
+		problems.merge("system_config", err)
+		graphSystems[""] = graphSystem
 	}
 
-	if nativeSystemConfig["endpoint"] != nil {
-		graphSystem.endpoint = nativeSystemConfig["endpoint"].(string)
-	} else {
-		return cdl.Err(fmt.Errorf("no endpoint specified in native system config"), cdl.LayerErrorBadParameter)
+	if hasGraphs {
+		graphsConfig, ok := graphs.(map[string]any)
+		if !ok {
+			problems.add("system_config: graphs must be an object of named connections")
+		}
+		names := make([]string, 0, len(graphsConfig))
+		for name := range graphsConfig {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			location := fmt.Sprintf("system_config graph %s", name)
+			graphSystemConfig, ok := graphsConfig[name].(map[string]any)
+			if !ok {
+				problems.add("%s: must be an object", location)
+				continue
+			}
+			graphSystem, err := NewGraphSystemConfig(name, graphSystemConfig)
+			problems.merge(location, err)
+			graphSystems[name] = graphSystem
+		}
 	}
 
-	if nativeSystemConfig["username"] != nil {
-		graphSystem.userName = nativeSystemConfig["username"].(string)
-	} else {
-		return cdl.Err(fmt.Errorf("no username specified in native system config"), cdl.LayerErrorBadParameter)
+	// group the dataset labels and their indexes by target graph and database
+	targets := make(map[string]graphTarget)
+	schemasByTarget := make(map[graphTarget][]LabelSchema)
+	labelOwners := make(map[graphTarget]map[string]string)
+	templates := make(map[string]*WriteTemplates)
+	indexOwners := make(map[graphTarget]map[string]string)
+	folderOwners := make(map[string]string) // folders a dataset writes files to, by clean path
+	for _, dataset := range config.DatasetDefinitions {
+		location := fmt.Sprintf("dataset %s", dataset.DatasetName)
+		datasetConfig, err := NewGraphDatasetConfig(dataset.SourceConfig)
+		if err != nil {
+			problems.merge(location, err)
+			continue
+		}
+		claimFolder(folderOwners, "bulk_import_dir", datasetConfig.BulkImportDir, dataset.DatasetName, &problems)
+		// a spool drains every batch in its folder, so a shared folder would write batches to the wrong label
+		claimFolder(folderOwners, "spool_dir", datasetConfig.SpoolDir, dataset.DatasetName, &problems)
+		graphSystem, ok := graphSystems[datasetConfig.Graph]
+		if !ok {
+			problems.add("%s: refers to unknown graph '%s'", location, datasetConfig.Graph)
+			continue
+		}
+		if graphSystem == nil {
+			// the graph has problems of its own
+			continue
+		}
+		if graphSystem.systemType == SystemTypeMemgraph {
+			memgraphProblems := configProblems{}
+			checkMemgraphIndexes(datasetConfig.Indexes, datasetConfig.DropUnmanagedIndexes, &memgraphProblems)
+			problems.merge(location, memgraphProblems.err())
+		}
+		database := datasetConfig.Database
+		if database == "" {
+			database = graphSystem.database
+		}
+		target := graphTarget{graph: datasetConfig.Graph, database: database}
+		targets[dataset.DatasetName] = target
+		if datasetConfig.Label == "" {
+			// read only datasets need a client but own no label
+			if _, ok := schemasByTarget[target]; !ok {
+				schemasByTarget[target] = nil
+			}
+			continue
+		}
+		if labelOwners[target] == nil {
+			labelOwners[target] = make(map[string]string)
+		}
+		if owner, ok := labelOwners[target][datasetConfig.Label]; ok {
+			problems.add("%s: label %s is already used by dataset %s in the same database", location, datasetConfig.Label, owner)
+			continue
+		}
+		labelOwners[target][datasetConfig.Label] = dataset.DatasetName
+		if indexOwners[target] == nil {
+			indexOwners[target] = make(map[string]string)
+		}
+		for _, index := range datasetConfig.Indexes {
+			name := index.indexName(datasetConfig.Label)
+			if owner, ok := indexOwners[target][name]; ok && owner != dataset.DatasetName {
+				problems.add("%s: index %s is already declared by dataset %s in the same database", location, name, owner)
+			}
+			indexOwners[target][name] = dataset.DatasetName
+		}
+		templates[dataset.DatasetName] = datasetConfig.WriteTemplates
+		schemasByTarget[target] = append(schemasByTarget[target], LabelSchema{Label: datasetConfig.Label, Indexes: datasetConfig.Indexes, DropUnmanaged: datasetConfig.DropUnmanagedIndexes})
 	}
 
-	if nativeSystemConfig["password"] != nil {
-		graphSystem.password = nativeSystemConfig["password"].(string)
-	} else {
-		return cdl.Err(fmt.Errorf("no password specified in native system config"), cdl.LayerErrorBadParameter)
+	if len(problems) > 0 {
+		return cdl.Err(fmt.Errorf("invalid configuration: %s", problems.Error()), cdl.LayerErrorBadParameter)
 	}
 
-	// configure the graph system
-	dl.graphSystem = graphSystem
+	// one query client per graph database
+	queryClients := make(map[graphTarget]GraphQueryClient)
+	for target := range schemasByTarget {
+		queryClient, err := dl.NewGraphQueryClient(graphSystems[target.graph], target.database)
+		if err != nil {
+			return cdl.Err(fmt.Errorf("could not create graph query client for graph '%s' database '%s' because %s", target.graph, target.database, err.Error()), cdl.LayerErrorInternal)
+		}
+		queryClients[target] = queryClient
+	}
 
-	// setup datasets
-	queryClient, err := dl.NewGraphQueryClient()
-	if err != nil {
-		return cdl.Err(fmt.Errorf("could not create graph query client because %s", err.Error()), cdl.LayerErrorInternal)
+	// custom write templates are planned by their graph, so errors in them fail the config instead of the syncs
+	for _, dataset := range config.DatasetDefinitions {
+		custom := templates[dataset.DatasetName].custom()
+		keys := make([]string, 0, len(custom))
+		for key := range custom {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			err := queryClients[targets[dataset.DatasetName]].Explain(dl.ctx, custom[key])
+			if err != nil && !isStatementError(err) {
+				target := targets[dataset.DatasetName]
+				return cdl.Err(fmt.Errorf("could not check write_templates.%s of dataset %s against graph '%s' database '%s' because %s", key, dataset.DatasetName, target.graph, target.database, err.Error()), cdl.LayerErrorInternal)
+			}
+			if err != nil {
+				problems.add("dataset %s: write_templates.%s is not valid cypher: %s", dataset.DatasetName, key, err.Error())
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return cdl.Err(fmt.Errorf("invalid configuration: %s", problems.Error()), cdl.LayerErrorBadParameter)
+	}
+
+	// the new datasets are set up before the running ones are replaced, so a config
+	// that cannot be used leaves the running datasets untouched
+	datasets := make(map[string]*GraphDataset)
+	layerErr := dl.setupDatasets(config, targets, queryClients, schemasByTarget, datasets)
+	if layerErr != nil {
+		for _, dataset := range datasets {
+			dataset.Stop()
+		}
+		return layerErr
+	}
+
+	// stop the spool workers of the previous datasets before the new ones take over their spools,
+	// syncs still running on them are left to finish
+	for _, dataset := range dl.datasets {
+		dataset.retire()
+	}
+	dl.config = config
+	dl.graphSystems = graphSystems
+	dl.targets = targets
+	dl.healthLock.Lock()
+	dl.queryClients = queryClients
+	dl.schemas = schemasByTarget
+	dl.healthLock.Unlock()
+	dl.datasets = datasets
+	if dl.command {
+		return nil
 	}
+	for _, dataset := range datasets {
+		dataset.Start()
+	}
+	dl.CheckHealth(dl.ctx)
+
+	return nil
+}
+
+// setupDatasets creates the datasets of the config and then, unless running a command, reconciles
+// the indexes and constraints of the labels in each graph database
+func (dl *OpenCypherDataLayer) setupDatasets(config *cdl.Config, targets map[string]graphTarget, queryClients map[graphTarget]GraphQueryClient, schemasByTarget map[graphTarget][]LabelSchema, datasets map[string]*GraphDataset) cdl.LayerError {
 	for _, dataset := range config.DatasetDefinitions {
-		dl.datasets[dataset.DatasetName], err =
-			NewGraphDataset(dataset.DatasetName, queryClient, dataset, dl.logger)
+		var err error
+		datasets[dataset.DatasetName], err =
+			NewGraphDataset(dataset.DatasetName, queryClients[targets[dataset.DatasetName]], dataset, dl.logger, dl.metrics)
 		if err != nil {
+			delete(datasets, dataset.DatasetName)
 			return cdl.Err(fmt.Errorf("could not create dataset %s because %s", dataset.DatasetName, err.Error()), cdl.LayerErrorInternal)
 		}
 	}
+	if dl.command {
+		return nil
+	}
 
+	for target, schemas := range schemasByTarget {
+		err := queryClients[target].Initialise(dl.ctx, schemas)
+		if err != nil {
+			return cdl.Err(fmt.Errorf("could not set up the indexes of graph '%s' database '%s' because %s", target.graph, target.database, err.Error()), cdl.LayerErrorInternal)
+		}
+	}
 	return nil
 }
 
+// claimFolder adds a problem when the folder of a dataset is already used by another dataset
+func claimFolder(owners map[string]string, key string, folder string, dataset string, problems *configProblems) {
+	if folder == "" {
+		return
+	}
+	folder = filepath.Clean(folder)
+	if owner, ok := owners[folder]; ok {
+		problems.add("dataset %s: %s %s is already used by dataset %s", dataset, key, folder, owner)
+		return
+	}
+	owners[folder] = dataset
+}
+
 func (dl *OpenCypherDataLayer) Dataset(dataset string) (cdl.Dataset, cdl.LayerError) {
 	dl.logger.Info(fmt.Sprintf("get dataset %s", dataset))
 	ds, ok := dl.datasets[dataset]
@@ -130,39 +470,230 @@ func (dl *OpenCypherDataLayer) Dataset(dataset string) (cdl.Dataset, cdl.LayerEr
 	return ds, nil
 }
 
+// ReplayDeadLetters replays the dead letters of the named dataset and returns how many were replayed
+func (dl *OpenCypherDataLayer) ReplayDeadLetters(ctx context.Context, dataset string) (int, error) {
+	ds, ok := dl.datasets[dataset]
+	if !ok {
+		return 0, fmt.Errorf("dataset %s not found", dataset)
+	}
+	return ds.ReplayDeadLetters(ctx)
+}
+
 func (dl *OpenCypherDataLayer) DatasetDescriptions() []*cdl.DatasetDescription {
 	dl.logger.Info("get dataset descriptions")
 	var datasetDescriptions []*cdl.DatasetDescription
 
+	dl.healthLock.Lock()
+	defer dl.healthLock.Unlock()
+
 	// iterate over the datasest testconfig and create one for each
-	for key := range dl.datasets {
-		datasetDescriptions = append(datasetDescriptions, &cdl.DatasetDescription{Name: key})
+	for key, dataset := range dl.datasets {
+		metadata := dataset.MetaData()
+		// the health endpoint of the service cannot be extended, so the health of the graph is listed here
+		if health, ok := dl.health[dl.targets[key]]; ok {
+			metadata["health"] = health
+		}
+		datasetDescriptions = append(datasetDescriptions, &cdl.DatasetDescription{Name: key, Metadata: metadata})
 	}
 
 	return datasetDescriptions
 }
 
+// HealthCheckInterval is the time between the health checks of a running layer
+const HealthCheckInterval = time.Minute
+
+// CheckHealth checks every graph database the datasets are stored in, logs and records the results,
+// and reports them in the dataset descriptions. Results that did not change since the last check are
+// only logged at debug level.
+func (dl *OpenCypherDataLayer) CheckHealth(ctx context.Context) []*HealthStatus {
+	dl.healthLock.Lock()
+	queryClients, schemas, previous := dl.queryClients, dl.schemas, dl.health
+	dl.healthLock.Unlock()
+
+	statuses := make([]*HealthStatus, 0, len(queryClients))
+	health := make(map[graphTarget]*HealthStatus)
+	for target, queryClient := range queryClients {
+		status := queryClient.CheckHealth(ctx, schemas[target])
+		health[target] = status
+		statuses = append(statuses, status)
+
+		log := dl.logger.Debug
+		if last, ok := previous[target]; !ok || last.Healthy != status.Healthy {
+			log = dl.logger.Info
+			if !status.Healthy {
+				log = dl.logger.Error
+			}
+		}
+		tags := []string{"graph:" + status.Graph}
+		if status.Healthy {
+			log("graph is healthy", "graph", status.Graph, "database", status.Database, "version", status.ServerVersion, "edition", status.Edition)
+			dl.metrics.Gauge("opencypher.health", 1, tags, 1)
+		} else {
+			log("graph is unhealthy", "graph", status.Graph, "database", status.Database, "error", status.Error, "missingIndexes", status.MissingIndexes)
+			dl.metrics.Gauge("opencypher.health", 0, tags, 1)
+		}
+	}
+
+	dl.healthLock.Lock()
+	dl.health = health
+	dl.healthLock.Unlock()
+	return statuses
+}
+
+// checkHealthPeriodically keeps the health in the dataset descriptions current until the layer stops
+func (dl *OpenCypherDataLayer) checkHealthPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dl.ctx.Done():
+			return
+		case <-ticker.C:
+			dl.CheckHealth(dl.ctx)
+		}
+	}
+}
+
+// default number of entities written per batch when batch_size is not set
+const DefaultBatchSize = 1000
+
+// NewGraphDatasetConfig reads and validates the source config of a dataset, returning all problems found together
 func NewGraphDatasetConfig(sourceConfig map[string]any) (*GraphDatasetConfig, error) {
-	data, err := json.Marshal(sourceConfig)
-	if err != nil {
-		return nil, err
+	problems := configProblems{}
+	// defaults are kept for keys that are not set or have a value of the wrong type
+	config := &GraphDatasetConfig{BatchSize: DefaultBatchSize, FullSyncMode: FullSyncModeTransactional, WriteWorkers: DefaultWriteWorkers}
+	decodeConfig(sourceConfig, config, &problems)
+
+	// datasets defined by a read query need no label and are then read only
+	if _, isString := sourceConfig["label"].(string); (isString || sourceConfig["label"] == nil) && (config.Label != "" || config.ReadQuery == nil) {
+		checkIdentifier("label", config.Label, &problems)
+	}
+	if config.ReadQuery != nil {
+		checkReadQuery(config.ReadQuery, sourceConfig, config.Label, &problems)
 	}
 
-	config := &GraphDatasetConfig{}
-	err = json.Unmarshal(data, config)
-	if err != nil {
-		return nil, err
+	if config.BatchSize < 1 {
+		problems.add("batch_size must be at least 1")
+	}
+
+	if config.FullSyncMode != FullSyncModeTransactional && config.FullSyncMode != FullSyncModeBulkImport {
+		problems.add("unsupported full sync mode %s", config.FullSyncMode)
+	}
+
+	if config.FullSyncMode == FullSyncModeBulkImport && config.BulkImportDir == "" {
+		problems.add("no bulk_import_dir specified for full sync mode %s", config.FullSyncMode)
+	}
+
+	if config.DeadLetter != nil {
+		if config.DeadLetter.Type != DeadLetterTypeDirectory && config.DeadLetter.Type != DeadLetterTypeGraph {
+			problems.add("unsupported dead letter type %s", config.DeadLetter.Type)
+		}
+		if config.DeadLetter.Type == DeadLetterTypeDirectory && config.DeadLetter.Path == "" {
+			problems.add("no path specified for dead letter directory")
+		}
+		if config.DeadLetter.Type == DeadLetterTypeGraph && config.DeadLetter.Label != "" {
+			checkIdentifier("dead_letter.label", config.DeadLetter.Label, &problems)
+		}
+	}
+
+	if config.WriteWorkers < 1 {
+		problems.add("write_workers must be at least 1")
+	}
+
+	if config.TransactionTimeout != "" {
+		timeout, err := time.ParseDuration(config.TransactionTimeout)
+		if err != nil || timeout < 0 {
+			problems.add("transaction_timeout must be a duration such as 30s or 5m")
+		}
+	}
+
+	if config.MaxBatchBytes < 0 {
+		problems.add("max_batch_bytes must not be negative")
+	}
+
+	if config.MaxRelationshipsPerStatement < 0 {
+		problems.add("max_relationships_per_statement must not be negative")
+	}
+
+	if config.DeleteChunkSize < 0 {
+		problems.add("delete_chunk_size must not be negative")
+	}
+
+	if config.SpoolRetryInterval != "" {
+		_, err := time.ParseDuration(config.SpoolRetryInterval)
+		if err != nil {
+			problems.add("spool_retry_interval must be a duration such as 5s or 1m")
+		}
 	}
 
+	checkIndexes(config.Indexes, &problems)
+	checkTemplates(config.WriteTemplates, &problems)
+
+	if config.Hooks != nil {
+		hooks := map[string][]string{
+			"before_full_sync":  config.Hooks.BeforeFullSync,
+			"after_full_sync":   config.Hooks.AfterFullSync,
+			"after_incremental": config.Hooks.AfterIncremental,
+		}
+		for _, kind := range []string{"before_full_sync", "after_full_sync", "after_incremental"} {
+			for i, statement := range hooks[kind] {
+				if strings.TrimSpace(statement) == "" {
+					problems.add("hooks.%s[%d] is empty", kind, i)
+				}
+			}
+		}
+		if config.FullSyncMode == FullSyncModeBulkImport && len(config.Hooks.BeforeFullSync)+len(config.Hooks.AfterFullSync) > 0 {
+			problems.add("full sync hooks are not run in full sync mode %s", FullSyncModeBulkImport)
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
 	return config, nil
 }
 
 type GraphDatasetConfig struct {
-	BatchSize int    `json:"batch_size"`
-	Label     string `json:"label"`
+	BatchSize                    int               `json:"batch_size"`
+	Label                        string            `json:"label"`
+	FullSyncMode                 string            `json:"full_sync_mode"`                  // transactional (default) or bulk_import
+	BulkImportDir                string            `json:"bulk_import_dir"`                 // folder for neo4j-admin import files when full_sync_mode is bulk_import
+	Database                     string            `json:"database"`                        // overrides the database from system_config
+	Graph                        string            `json:"graph"`                           // name of the graph connection in system_config graphs, empty for the default
+	DeadLetter                   *DeadLetterConfig `json:"dead_letter"`                     // optional store for entities that cannot be written
+	SpoolDir                     string            `json:"spool_dir"`                       // optional folder spooling incremental batches before they are written
+	SpoolRetryInterval           string            `json:"spool_retry_interval"`            // initial wait between drain attempts while the graph is failing, defaults to 5s
+	WriteWorkers                 int               `json:"write_workers"`                   // number of batches written concurrently, defaults to 1
+	TransactionTimeout           string            `json:"transaction_timeout"`             // server side timeout of write transactions, defaults to the server setting
+	MaxBatchBytes                int               `json:"max_batch_bytes"`                 // flush a batch once its entities add up to this many bytes of json, 0 for no limit
+	MaxRelationshipsPerStatement int               `json:"max_relationships_per_statement"` // split relationship updates into statements of this size, 0 for no limit
+	DeleteChunkSize              int               `json:"delete_chunk_size"`               // nodes or relationships removed per transaction when deleting the dataset, defaults to 10000
+	Indexes                      []IndexConfig     `json:"indexes"`                         // indexes and constraints kept in addition to the index on gid
+	DropUnmanagedIndexes         bool              `json:"drop_unmanaged_indexes"`          // drop other indexes and constraints on the label and the indexed relationship types
+	Hooks                        *HooksConfig      `json:"hooks"`                           // optional cypher run before and after syncs
+	WriteTemplates               *WriteTemplates   `json:"write_templates"`                 // optional statements writing the entities
+	ReadQuery                    *ReadQueryConfig  `json:"read_query"`                      // optional query defining the entities read from the dataset
 }
 
-func NewGraphDataset(name string, queryClient GraphQueryClient, datasetDefinition *cdl.DatasetDefinition, logger cdl.Logger) (*GraphDataset, error) {
+// WriteOptions returns the write transaction limits of the dataset
+func (c *GraphDatasetConfig) WriteOptions() WriteOptions {
+	// validated when the config is read
+	timeout, _ := time.ParseDuration(c.TransactionTimeout)
+	return WriteOptions{TransactionTimeout: timeout, MaxRelationshipsPerStatement: c.MaxRelationshipsPerStatement, DeleteChunkSize: c.DeleteChunkSize, Vectors: c.vectors(), Templates: c.WriteTemplates}
+}
+
+// vectors returns the dimensions of the properties with a vector index
+func (c *GraphDatasetConfig) vectors() map[string]int {
+	vectors := make(map[string]int)
+	for _, index := range c.Indexes {
+		if index.indexType() == IndexTypeVector && len(index.Properties) == 1 {
+			vectors[index.Properties[0]] = index.Dimensions
+		}
+	}
+	return vectors
+}
+
+func NewGraphDataset(name string, queryClient GraphQueryClient, datasetDefinition *cdl.DatasetDefinition, logger cdl.Logger, metrics cdl.Metrics) (*GraphDataset, error) {
 	sourceConfig := datasetDefinition.SourceConfig
 
 	config, err := NewGraphDatasetConfig(sourceConfig)
@@ -170,11 +701,42 @@ func NewGraphDataset(name string, queryClient GraphQueryClient, datasetDefinitio
 		return nil, err
 	}
 
-	return &GraphDataset{name: name,
+	deadLetterConfig := config.DeadLetter
+	if deadLetterConfig == nil && config.SpoolDir != "" {
+		// spooled batches are acknowledged already, so rejected entities must be kept somewhere
+		deadLetterConfig = &DeadLetterConfig{Type: DeadLetterTypeDirectory, Path: filepath.Join(config.SpoolDir, "deadletters")}
+	}
+
+	var deadLetters DeadLetterStore
+	if deadLetterConfig != nil {
+		deadLetters, err = NewDeadLetterStore(deadLetterConfig, name, queryClient)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dataset := &GraphDataset{name: name,
 		config:            config,
 		datasetDefinition: datasetDefinition,
 		logger:            logger,
-		queryClient:       queryClient}, nil
+		metrics:           metrics,
+		queryClient:       queryClient,
+		deadLetters:       deadLetters,
+		tags:              metricTags(name, config.Graph)}
+	dataset.stopped, dataset.stop = context.WithCancel(context.Background())
+
+	if config.SpoolDir != "" {
+		retryInterval := 5 * time.Second
+		if config.SpoolRetryInterval != "" {
+			retryInterval, _ = time.ParseDuration(config.SpoolRetryInterval)
+		}
+		dataset.spool, err = NewSpool(config.SpoolDir, name, retryInterval, dataset.writeDirect, logger, metrics, dataset.tags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dataset, nil
 }
 
 type GraphDataset struct {
@@ -183,10 +745,125 @@ type GraphDataset struct {
 	datasetDefinition *cdl.DatasetDefinition // the dataset definition with mappings etc
 	config            *GraphDatasetConfig    // the dataset config
 	queryClient       GraphQueryClient       // the query client
+	deadLetters       DeadLetterStore        // optional store for rejected entities
+	spool             *Spool                 // optional on-disk queue for incremental batches
+	metrics           cdl.Metrics
+	tags              []string        // metric tags of the dataset
+	stopped           context.Context // cancelled when the dataset is stopped
+	stop              context.CancelFunc
+	syncLock          sync.Mutex
+	fullSync          *SyncStats // totals of the running full sync
+	lastSync          *SyncStats // totals of the last completed sync
+}
+
+// Start starts the background work of the dataset
+func (f *GraphDataset) Start() {
+	if f.spool != nil {
+		f.spool.Start()
+	}
+}
+
+// retire ends the background work of a dataset replaced by a config change. Unlike Stop it leaves
+// running syncs alone, so editing the config does not abort them.
+func (f *GraphDataset) retire() {
+	if f.spool != nil {
+		f.spool.Stop()
+	}
+}
+
+// Stop ends background work of the dataset and aborts running database work
+func (f *GraphDataset) Stop() {
+	f.stop()
+	if f.spool != nil {
+		f.spool.Stop()
+	}
+}
+
+// withStop returns a context that is done when either ctx is done or the dataset is stopped
+func (f *GraphDataset) withStop(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	unregister := context.AfterFunc(f.stopped, cancel)
+	return ctx, func() {
+		unregister()
+		cancel()
+	}
 }
 
 func (f *GraphDataset) MetaData() map[string]any {
-	return make(map[string]any)
+	metaData := make(map[string]any)
+	f.syncLock.Lock()
+	defer f.syncLock.Unlock()
+	if f.lastSync != nil {
+		metaData["lastSync"] = *f.lastSync
+	}
+	if f.fullSync != nil {
+		metaData["runningFullSync"] = *f.fullSync
+	}
+	return metaData
+}
+
+// fullSyncWritten adds the totals of a full sync batch and completes the sync with its last batch, or
+// with the first batch that fails
+func (f *GraphDataset) fullSyncWritten(batchInfo cdl.BatchInfo, stats SyncStats) {
+	f.syncLock.Lock()
+	defer f.syncLock.Unlock()
+	if f.fullSync == nil || f.fullSync.SyncId != batchInfo.SyncId {
+		// the start batch went to an earlier instance of the dataset
+		f.fullSync = &SyncStats{SyncId: batchInfo.SyncId, Type: SyncTypeFull, Started: stats.Started}
+	}
+	f.fullSync.Batches += stats.Batches
+	f.fullSync.Entities += stats.Entities
+	f.fullSync.Add(stats.WriteStats)
+	if stats.Error != "" {
+		f.fullSync.Error = stats.Error
+	}
+
+	if batchInfo.IsLastBatch || stats.Error != "" {
+		f.fullSync.Finished = stats.Finished
+		f.lastSync = f.fullSync
+		f.fullSync = nil
+		if stats.Error != "" {
+			f.logger.Warn(fmt.Sprintf("full sync %s for dataset %s failed", batchInfo.SyncId, f.name), "error", stats.Error)
+			return
+		}
+		f.metrics.Timing("opencypher.fullsync.duration", f.lastSync.Finished.Sub(f.lastSync.Started), f.tags, 1)
+		f.logger.Info(fmt.Sprintf("full sync %s for dataset %s completed", batchInfo.SyncId, f.name),
+			append([]any{"batches", f.lastSync.Batches, "entities", f.lastSync.Entities}, f.lastSync.logArgs()...)...)
+	}
+}
+
+// incrementalWritten records the totals of an incremental write
+func (f *GraphDataset) incrementalWritten(stats SyncStats) {
+	f.syncLock.Lock()
+	defer f.syncLock.Unlock()
+	stats.Type = SyncTypeIncremental
+	f.lastSync = &stats
+	f.metrics.Timing("opencypher.incremental.duration", stats.Finished.Sub(stats.Started), f.tags, 1)
+	f.logger.Info(fmt.Sprintf("incremental sync for dataset %s completed", f.name),
+		append([]any{"batches", stats.Batches, "entities", stats.Entities}, stats.logArgs()...)...)
+}
+
+// fullSyncFailed completes the running full sync with the error that stopped it
+func (f *GraphDataset) fullSyncFailed(err error) {
+	f.syncLock.Lock()
+	defer f.syncLock.Unlock()
+	if f.fullSync == nil {
+		return
+	}
+	f.fullSync.Finished = time.Now().UTC()
+	f.fullSync.Error = err.Error()
+	f.lastSync = f.fullSync
+	f.fullSync = nil
+}
+
+// afterIncremental returns the hooks run after an incremental sync, nil when there are none
+func (f *GraphDataset) afterIncremental() func(ctx context.Context) (WriteStats, error) {
+	if f.config.Hooks == nil || len(f.config.Hooks.AfterIncremental) == 0 {
+		return nil
+	}
+	return func(ctx context.Context) (WriteStats, error) {
+		return f.runHooks(ctx, "after_incremental", f.config.Hooks.AfterIncremental, "")
+	}
 }
 
 func (f *GraphDataset) Name() string {
@@ -195,60 +872,397 @@ func (f *GraphDataset) Name() string {
 
 func (f *GraphDataset) FullSync(ctx context.Context, batchInfo cdl.BatchInfo) (cdl.DatasetWriter, cdl.LayerError) {
 	f.logger.Info(fmt.Sprintf("full sync for dataset %s", f.name))
+	if f.config.Label == "" {
+		return nil, f.readOnly()
+	}
+	if f.config.FullSyncMode == FullSyncModeBulkImport {
+		// the graph is left untouched, files are imported offline with neo4j-admin
+		datasetWriter, err := NewBulkImportDatasetWriter(f.config.BulkImportDir, f.name, f.config.Label, f.config.BatchSize, f.config.vectors(), batchInfo, f.logger)
+		if err != nil {
+			return nil, cdl.Err(fmt.Errorf("could not create bulk import writer because %s", err.Error()), cdl.LayerErrorInternal)
+		}
+		return datasetWriter, nil
+	}
+
+	ctx, span := startSpan(ctx, "FullSync", trace.WithAttributes(
+		attribute.String("opencypher.dataset", f.name),
+		attribute.String("opencypher.sync_id", batchInfo.SyncId),
+		attribute.Bool("opencypher.start_batch", batchInfo.IsStartBatch),
+		attribute.Bool("opencypher.last_batch", batchInfo.IsLastBatch),
+	))
+	startCtx, cancel := f.withStop(ctx)
+	defer cancel()
+
+	if batchInfo.IsStartBatch && f.spool != nil {
+		// spooled incremental batches are older than the full sync and must land first
+		err := f.spool.Drain(startCtx)
+		if err != nil {
+			endSpan(span, err)
+			return nil, cdl.Err(fmt.Errorf("could not drain spool before full sync because %s", err.Error()), cdl.LayerErrorInternal)
+		}
+	}
+
 	if batchInfo.IsStartBatch {
+		f.syncLock.Lock()
+		f.fullSync = &SyncStats{SyncId: batchInfo.SyncId, Type: SyncTypeFull, Started: time.Now().UTC()}
+		f.syncLock.Unlock()
+
+		if f.config.Hooks != nil && len(f.config.Hooks.BeforeFullSync) > 0 {
+			stats, err := f.runHooks(startCtx, "before_full_sync", f.config.Hooks.BeforeFullSync, batchInfo.SyncId)
+			f.syncLock.Lock()
+			f.fullSync.Add(stats)
+			f.syncLock.Unlock()
+			if err != nil {
+				f.fullSyncFailed(err)
+				endSpan(span, err)
+				return nil, cdl.Err(err, cdl.LayerErrorInternal)
+			}
+		}
+
 		f.logger.Debug(fmt.Sprintf("start batch full sync for dataset %s", f.name))
 		// delete all data in the graph with this dataset name source
-		err := f.queryClient.DeleteAll(f.name, f.config.Label)
+		err := f.queryClient.DeleteAll(startCtx, f.name, f.config.Label, f.config.WriteOptions())
 		if err != nil {
+			endSpan(span, err)
 			return nil, cdl.Err(fmt.Errorf("could not delete all data in the graph because %s", err.Error()), cdl.LayerErrorInternal)
 		}
 	}
 
-	datasetWriter := &CypherDatasetWriter{logger: f.logger, GraphQueryClient: f.queryClient, datasetName: f.name, label: f.config.Label, BatchSize: f.config.BatchSize, toWrite: make([]*egdm.Entity, 0)}
-	return datasetWriter, nil
+	writer := f.newCypherDatasetWriter(ctx, batchInfo.SyncId, nil)
+	writer.span = span
+	writer.written = func(stats SyncStats) { f.fullSyncWritten(batchInfo, stats) }
+	if batchInfo.IsLastBatch && f.config.Hooks != nil && len(f.config.Hooks.AfterFullSync) > 0 {
+		writer.after = func(ctx context.Context) (WriteStats, error) {
+			return f.runHooks(ctx, "after_full_sync", f.config.Hooks.AfterFullSync, batchInfo.SyncId)
+		}
+	}
+	return writer, nil
 }
 
 func (f *GraphDataset) Incremental(ctx context.Context) (cdl.DatasetWriter, cdl.LayerError) {
 	f.logger.Info(fmt.Sprintf("incremental sync for dataset %s", f.name))
-	datasetWriter := &CypherDatasetWriter{logger: f.logger, GraphQueryClient: f.queryClient, datasetName: f.name, label: f.config.Label, BatchSize: f.config.BatchSize, toWrite: make([]*egdm.Entity, 0)}
-	return datasetWriter, nil
+	if f.config.Label == "" {
+		return nil, f.readOnly()
+	}
+	ctx, span := startSpan(ctx, "Incremental", trace.WithAttributes(attribute.String("opencypher.dataset", f.name)))
+	writer := f.newCypherDatasetWriter(ctx, "", f.spool)
+	writer.span = span
+	if f.spool == nil {
+		// spooled batches are counted, and followed by the hooks, when the spool writes them
+		writer.written = f.incrementalWritten
+		writer.after = f.afterIncremental()
+	}
+	return writer, nil
+}
+
+// ReplayDeadLetters writes the dataset's dead letters through an incremental writer. Entities that are
+// rejected again are stored as new dead letters.
+func (f *GraphDataset) ReplayDeadLetters(ctx context.Context) (int, error) {
+	if f.deadLetters == nil {
+		return 0, fmt.Errorf("no dead letter store configured for dataset %s", f.name)
+	}
+
+	f.logger.Info(fmt.Sprintf("replaying dead letters for dataset %s", f.name))
+	count := 0
+	err := f.deadLetters.Replay(ctx, func(letters []*DeadLetter) error {
+		writer, err := f.Incremental(ctx)
+		if err != nil {
+			return err
+		}
+		for _, letter := range letters {
+			err = writer.Write(letter.Entity)
+			if err != nil {
+				return err
+			}
+		}
+		count += len(letters)
+		return writer.Close()
+	})
+	return count, err
+}
+
+// writeDirect writes entities straight to the graph, used by the spool when draining
+func (f *GraphDataset) writeDirect(ctx context.Context, entities []*egdm.Entity) error {
+	writer := f.newCypherDatasetWriter(ctx, "", nil)
+	writer.written = f.incrementalWritten
+	writer.toWrite = entities
+	err := writer.Close()
+	if err != nil {
+		return err
+	}
+
+	// the entities are written, so a failing hook is reported on the sync instead of keeping the batch
+	// in the spool to be written again
+	if after := f.afterIncremental(); after != nil {
+		stats, err := after(ctx)
+		f.syncLock.Lock()
+		if f.lastSync != nil {
+			f.lastSync.Add(stats)
+			if err != nil {
+				f.lastSync.Error = err.Error()
+			}
+		}
+		f.syncLock.Unlock()
+		if err != nil {
+			f.logger.Error(fmt.Sprintf("hooks after spooled batch of dataset %s failed", f.name), "error", err.Error())
+		}
+	}
+	return nil
+}
+
+func (f *GraphDataset) newCypherDatasetWriter(ctx context.Context, syncId string, spool *Spool) *CypherDatasetWriter {
+	ctx, cancel := f.withStop(ctx)
+	writer := &CypherDatasetWriter{ctx: ctx, cancel: cancel, stats: SyncStats{Started: time.Now().UTC()}, logger: f.logger, metrics: f.metrics, tags: f.tags, GraphQueryClient: f.queryClient, datasetName: f.name, label: f.config.Label, BatchSize: f.config.BatchSize, MaxBatchBytes: f.config.MaxBatchBytes, options: f.config.WriteOptions(), toWrite: make([]*egdm.Entity, 0), syncId: syncId, deadLetters: f.deadLetters, spool: spool}
+	if spool == nil {
+		writer.pipeline = newWritePipeline(f.config.WriteWorkers, writer.writeBatch)
+	}
+	return writer
 }
 
 type CypherDatasetWriter struct {
+	ctx              context.Context // of the sync request, also done when the dataset is stopped
+	cancel           context.CancelFunc
 	logger           cdl.Logger
+	metrics          cdl.Metrics
+	tags             []string
 	closeFullSync    bool
 	GraphQueryClient GraphQueryClient
 	BatchSize        int
+	MaxBatchBytes    int // 0 for no limit
+	options          WriteOptions
 	toWrite          []*egdm.Entity
+	toWriteBytes     int // json size of toWrite, only tracked when MaxBatchBytes is set
+	received         int // entities passed to Write since the last flush, spooled batches are counted when received only
 	label            string
 	datasetName      string
+	rejected         []*RejectedEntity                             // entities isolated as the cause of failing batches
+	stats            SyncStats                                     // totals of the batches written by this writer
+	lock             sync.Mutex                                    // guards rejected and stats, batches may be written concurrently
+	written          func(stats SyncStats)                         // optional callback with the totals once all batches are written, or with the error that failed them
+	reported         bool                                          // written has been called
+	after            func(ctx context.Context) (WriteStats, error) // optional hooks run once all batches are written
+	span             trace.Span                                    // span of the sync request, ended on close
+	syncId           string                                        // full sync id, empty for incremental writes
+	deadLetters      DeadLetterStore                               // when set rejected entities are stored here instead of failing the write
+	spool            *Spool                                        // when set batches are spooled to disk and written by the spool worker
+	pipeline         *writePipeline                                // when set batches are written in the background, otherwise before flush returns
+}
+
+// RejectedEntity is an entity the graph refused to store together with the server error
+type RejectedEntity struct {
+	Entity *egdm.Entity
+	Error  string
 }
 
 func (f *CypherDatasetWriter) Write(entity *egdm.Entity) cdl.LayerError {
+	if f.pipeline != nil {
+		err := f.pipeline.failed()
+		if err != nil {
+			return f.fail(cdl.Err(fmt.Errorf("could not write batch because %s", err.Error()), cdl.LayerErrorInternal))
+		}
+	}
+
+	if f.MaxBatchBytes > 0 {
+		data, err := json.Marshal(entity)
+		if err != nil {
+			return f.fail(cdl.Err(fmt.Errorf("could not measure entity %s because %s", entity.ID, err.Error()), cdl.LayerErrorBadParameter))
+		}
+		// flush first when the entity would take the batch over the limit, a larger entity is written alone
+		if len(f.toWrite) > 0 && f.toWriteBytes+len(data) > f.MaxBatchBytes {
+			layerErr := f.flush()
+			if layerErr != nil {
+				return f.fail(layerErr)
+			}
+		}
+		f.toWriteBytes += len(data)
+	}
+
 	f.toWrite = append(f.toWrite, entity)
+	f.received++
 	if len(f.toWrite) >= f.BatchSize {
-		f.logger.Debug(fmt.Sprintf("writing batch of %d entities to dataset %s", len(f.toWrite), f.datasetName))
-		err := f.GraphQueryClient.WriteBatch(f.datasetName, f.label, f.toWrite)
+		err := f.flush()
 		if err != nil {
-			return cdl.Err(fmt.Errorf("could not write batch because %s", err.Error()), cdl.LayerErrorInternal)
+			return f.fail(err)
 		}
-		f.toWrite = make([]*egdm.Entity, 0)
 	}
 	return nil
 }
 
+// fail ends the request with the error and reports it to the sync. A request failing in Write is
+// never closed, so its context is cancelled here to stop the batches still running in the pipeline.
+func (f *CypherDatasetWriter) fail(err cdl.LayerError) cdl.LayerError {
+	if f.cancel != nil {
+		f.cancel()
+	}
+	if f.span != nil {
+		endSpan(f.span, err)
+		f.span = nil
+	}
+	if f.written == nil || f.reported {
+		return err
+	}
+	f.reported = true
+	// batches still running in the pipeline may be adding to the totals
+	f.lock.Lock()
+	stats := f.stats
+	f.lock.Unlock()
+	stats.Error = err.Error()
+	stats.Finished = time.Now().UTC()
+	f.written(stats)
+	return err
+}
+
 func (f *CypherDatasetWriter) Close() cdl.LayerError {
+	err := f.close()
+	if f.span != nil {
+		endSpan(f.span, err)
+	}
+	return err
+}
+
+func (f *CypherDatasetWriter) close() cdl.LayerError {
 	f.logger.Info(fmt.Sprintf("closing dataset writer for dataset %s", f.datasetName))
+	if f.cancel != nil {
+		defer f.cancel()
+	}
 	if len(f.toWrite) > 0 {
-		f.logger.Debug(fmt.Sprintf("writing batch of %d entities to dataset %s", len(f.toWrite), f.datasetName))
-		err := f.GraphQueryClient.WriteBatch(f.datasetName, f.label, f.toWrite)
+		err := f.flush()
+		if err != nil {
+			return f.fail(err)
+		}
+	}
+
+	if f.pipeline != nil {
+		err := f.pipeline.wait()
+		if err != nil {
+			return f.fail(cdl.Err(fmt.Errorf("could not write batch because %s", err.Error()), cdl.LayerErrorInternal))
+		}
+	}
+
+	var hookErr error
+	if f.after != nil {
+		stats, err := f.after(f.ctx)
+		f.stats.Add(stats)
+		if err != nil {
+			hookErr = err
+			f.stats.Error = err.Error()
+		}
+	}
+
+	if f.written != nil && !f.reported {
+		f.reported = true
+		f.stats.Finished = time.Now().UTC()
+		f.written(f.stats)
+	}
+
+	if len(f.rejected) > 0 && f.deadLetters != nil {
+		letters := make([]*DeadLetter, 0, len(f.rejected))
+		for _, rejection := range f.rejected {
+			letters = append(letters, NewDeadLetter(rejection.Entity, rejection.Error, f.syncId))
+		}
+		err := f.deadLetters.Store(f.ctx, letters)
 		if err != nil {
-			return cdl.Err(fmt.Errorf("could not write batch because %s", err.Error()), cdl.LayerErrorInternal)
+			return cdl.Err(fmt.Errorf("could not store dead letters because %s: %s", err.Error(), rejectedError(f.rejected)), cdl.LayerErrorInternal)
 		}
+		f.logger.Warn(fmt.Sprintf("stored %d rejected entities as dead letters for dataset %s", len(letters), f.datasetName))
+		f.rejected = nil
+	}
+
+	if hookErr != nil {
+		return cdl.Err(hookErr, cdl.LayerErrorInternal)
+	}
+
+	if len(f.rejected) > 0 {
+		return cdl.Err(rejectedError(f.rejected), cdl.LayerErrorBadParameter)
+	}
+	return nil
+}
+
+func (f *CypherDatasetWriter) flush() cdl.LayerError {
+	if f.received > 0 {
+		addTotal(f.metrics, "opencypher.entities.received", f.tags, f.received)
+		f.received = 0
+	}
+	if f.spool != nil {
+		f.logger.Debug(fmt.Sprintf("spooling batch of %d entities for dataset %s", len(f.toWrite), f.datasetName))
+		_, span := startSpan(f.ctx, "SpoolBatch", trace.WithAttributes(attribute.Int("opencypher.entities", len(f.toWrite))))
+		err := f.spool.Append(f.toWrite)
+		endSpan(span, err)
+		if err != nil {
+			return cdl.Err(fmt.Errorf("could not spool batch because %s", err.Error()), cdl.LayerErrorInternal)
+		}
+		f.toWrite = make([]*egdm.Entity, 0)
+		f.toWriteBytes = 0
+		return nil
+	}
+
+	f.logger.Debug(fmt.Sprintf("writing batch of %d entities to dataset %s", len(f.toWrite), f.datasetName))
+	var err error
+	if f.pipeline != nil {
+		err = f.pipeline.submit(f.toWrite)
+	} else {
+		err = f.writeBatch(f.toWrite)
 	}
+	if err != nil {
+		return cdl.Err(fmt.Errorf("could not write batch because %s", err.Error()), cdl.LayerErrorInternal)
+	}
+	f.toWrite = make([]*egdm.Entity, 0)
+	f.toWriteBytes = 0
 	return nil
 }
 
+// writeBatch writes the entities, and when the batch fails with an error caused by entity content splits
+// it in halves until the offending entities are isolated. These are rejected and everything else is
+// written. Any other error fails the whole batch as splitting would not help.
+func (f *CypherDatasetWriter) writeBatch(entities []*egdm.Entity) error {
+	ctx, span := startSpan(f.ctx, "WriteBatch", trace.WithAttributes(attribute.Int("opencypher.entities", len(entities))))
+	stats, err := f.GraphQueryClient.WriteBatch(ctx, f.datasetName, f.label, entities, f.options)
+	endSpan(span, err)
+	if err == nil {
+		f.lock.Lock()
+		f.stats.Batches++
+		f.stats.Entities += len(entities)
+		f.stats.Add(stats)
+		f.lock.Unlock()
+		return nil
+	}
+	if !isEntityError(err) || f.ctx.Err() != nil {
+		return err
+	}
+
+	if len(entities) == 1 {
+		f.logger.Error(fmt.Sprintf("rejected entity %s in dataset %s", entities[0].ID, f.datasetName), "error", err.Error())
+		f.lock.Lock()
+		f.rejected = append(f.rejected, &RejectedEntity{Entity: entities[0], Error: err.Error()})
+		f.lock.Unlock()
+		f.metrics.Incr("opencypher.entities.rejected", f.tags, 1)
+		return nil
+	}
+
+	f.logger.Warn(fmt.Sprintf("splitting failed batch of %d entities in dataset %s", len(entities), f.datasetName), "error", err.Error())
+	half := len(entities) / 2
+	err = f.writeBatch(entities[:half])
+	if err != nil {
+		return err
+	}
+	return f.writeBatch(entities[half:])
+}
+
+// maximum number of rejected entities listed in the error returned from Close
+const maxReportedRejections = 10
+
+func rejectedError(rejected []*RejectedEntity) error {
+	reports := make([]string, 0, maxReportedRejections)
+	for i, rejection := range rejected {
+		if i == maxReportedRejections {
+			reports = append(reports, fmt.Sprintf("and %d more", len(rejected)-maxReportedRejections))
+			break
+		}
+		reports = append(reports, fmt.Sprintf("%s (%s)", rejection.Entity.ID, rejection.Error))
+	}
+	return fmt.Errorf("%d entities were rejected by the graph: %s", len(rejected), strings.Join(reports, "; "))
+}
+
 type FileInfo struct {
 	Entry fs.DirEntry
 	Path  string
@@ -258,8 +1272,3 @@ func (f *GraphDataset) Changes(since string, limit int, latestOnly bool) (cdl.En
 	f.logger.Info(fmt.Sprintf("get changes for dataset %s", f.name))
 	return nil, cdl.Err(fmt.Errorf("operation not supported"), cdl.LayerNotSupported)
 }
-
-func (f *GraphDataset) Entities(from string, limit int) (cdl.EntityIterator, cdl.LayerError) {
-	f.logger.Info(fmt.Sprintf("get entities for dataset %s", f.name))
-	return nil, cdl.Err(fmt.Errorf("operation not supported"), cdl.LayerNotSupported)
-}
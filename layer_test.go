@@ -3,12 +3,19 @@ package layer
 import (
 	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"github.com/google/uuid"
 	cdl "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j/dbtype"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,10 +24,6 @@ func TestStartStopFileSystemDataLayer(t *testing.T) {
 	configLocation := "./testconfig"
 	serviceRunner := cdl.NewServiceRunner(NewOpenCypherDataLayer)
 	serviceRunner.WithConfigLocation(configLocation)
-	serviceRunner.WithEnrichConfig(func(config *cdl.Config) error {
-		config.NativeSystemConfig["path"] = "/tmp"
-		return nil
-	})
 	err := serviceRunner.Start()
 	if err != nil {
 		t.Error(err)
@@ -63,10 +66,6 @@ func TestWriteFullSync(t *testing.T) {
 	configLocation := "./testconfig"
 	serviceRunner := cdl.NewServiceRunner(NewOpenCypherDataLayer)
 	serviceRunner.WithConfigLocation(configLocation)
-	serviceRunner.WithEnrichConfig(func(config *cdl.Config) error {
-		config.NativeSystemConfig["path"] = folderName
-		return nil
-	})
 
 	err := serviceRunner.Start()
 	if err != nil {
@@ -255,10 +254,6 @@ func TestWriteIncremental(t *testing.T) {
 	configLocation := "./testconfig"
 	serviceRunner := cdl.NewServiceRunner(NewOpenCypherDataLayer)
 	serviceRunner.WithConfigLocation(configLocation)
-	serviceRunner.WithEnrichConfig(func(config *cdl.Config) error {
-		config.NativeSystemConfig["path"] = folderName
-		return nil
-	})
 
 	// tidy up graph data before we start
 	ctx := context.Background()
@@ -441,3 +436,324 @@ func makeEntity(id string) *egdm.Entity {
 	entity.SetReference("http://data.sample.org/worksfor", "http://data.sample.org/things/mimiro")
 	return entity
 }
+
+// testMetrics counts the metrics emitted by the layer
+type testMetrics struct {
+	lock     sync.Mutex
+	counters map[string]int
+	gauges   map[string]float64
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{counters: make(map[string]int), gauges: make(map[string]float64)}
+}
+
+// Incr counts one per call like statsd, the last argument is the sample rate
+func (m *testMetrics) Incr(s string, tags []string, rate int) cdl.LayerError {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.counters[s]++
+	// also count per tag, so tests can ask for e.g. "opencypher.write.errors#category:client"
+	for _, tag := range tags {
+		m.counters[s+"#"+tag]++
+	}
+	return nil
+}
+
+func (m *testMetrics) Timing(s string, timed time.Duration, tags []string, i int) cdl.LayerError {
+	return nil
+}
+
+func (m *testMetrics) Gauge(s string, f float64, tags []string, i int) cdl.LayerError {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.gauges[s] = f
+	return nil
+}
+
+func (m *testMetrics) gauge(s string) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.gauges[s]
+}
+
+func (m *testMetrics) count(s string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.counters[s]
+}
+
+// fakeQueryClient records written batches and fails any batch containing one of the poison entity ids
+type fakeQueryClient struct {
+	lock        sync.Mutex
+	poison      map[string]bool
+	unavailable bool                                        // fail every batch with a connectivity error
+	delay       func(entities []*egdm.Entity) time.Duration // optional time each batch takes to write
+	written     []*egdm.Entity
+	batches     int
+	running     int
+	maxRunning  int
+	statements  []string         // statements run by ExecuteStatement
+	failOn      string           // fail statements containing this text
+	params      map[string]any   // parameters of the last statement
+	rows        []map[string]any // rows returned by Query
+	pageBy      string           // column of the rows compared with the continuation
+}
+
+func (c *fakeQueryClient) Initialise(ctx context.Context, schemas []LabelSchema) error {
+	return nil
+}
+
+func (c *fakeQueryClient) DeleteAll(ctx context.Context, source string, label string, options WriteOptions) error {
+	return nil
+}
+
+func (c *fakeQueryClient) WriteBatch(ctx context.Context, source string, label string, entities []*egdm.Entity, options WriteOptions) (WriteStats, error) {
+	if c.delay != nil {
+		c.lock.Lock()
+		c.running++
+		c.maxRunning = max(c.maxRunning, c.running)
+		c.lock.Unlock()
+		time.Sleep(c.delay(entities))
+		defer func() {
+			c.lock.Lock()
+			c.running--
+			c.lock.Unlock()
+		}()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.batches++
+	if c.unavailable {
+		return WriteStats{}, &neo4j.ConnectivityError{Inner: errors.New("connection refused")}
+	}
+	for _, entity := range entities {
+		if c.poison[entity.ID] {
+			return WriteStats{}, &neo4j.Neo4jError{Code: "Neo.ClientError.Statement.TypeError", Msg: "unsupported property value"}
+		}
+	}
+	c.written = append(c.written, entities...)
+	return WriteStats{NodesCreated: len(entities), RelationshipsCreated: len(entities)}, nil
+}
+
+func (c *fakeQueryClient) StoreDeadLetters(ctx context.Context, source string, label string, letters []*DeadLetter) error {
+	return nil
+}
+
+func (c *fakeQueryClient) DeadLetters(ctx context.Context, source string, label string) ([]*DeadLetter, error) {
+	return nil, nil
+}
+
+func (c *fakeQueryClient) DeleteDeadLetters(ctx context.Context, source string, label string, ids []string) error {
+	return nil
+}
+
+// Query pages through the rows, continuing after the row whose pageBy column, gid by default, holds the
+// continuation value with the same type
+func (c *fakeQueryClient) Query(ctx context.Context, query string, params map[string]any) ([]map[string]any, error) {
+	column := c.pageBy
+	if column == "" {
+		column = "gid"
+	}
+	start := 0
+	for i, row := range c.rows {
+		if node, ok := row["n"]; ok {
+			row, _ = nodeProperties(node)
+		}
+		if row[column] == params["continuation"] {
+			start = i + 1
+		}
+	}
+	return c.rows[start:min(start+params["limit"].(int), len(c.rows))], nil
+}
+
+func TestWriterIsolatesRejectedEntities(t *testing.T) {
+	client := &fakeQueryClient{poison: map[string]bool{
+		"http://data.sample.org/things/3": true,
+		"http://data.sample.org/things/6": true,
+	}}
+	writer := &CypherDatasetWriter{ctx: context.Background(), logger: cdl.NewLogger("test", "text", "info"), metrics: newTestMetrics(), GraphQueryClient: client, datasetName: "people", label: "Person", BatchSize: 8}
+
+	for i := 0; i < 10; i++ {
+		err := writer.Write(makeEntity(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := writer.Close()
+	if err == nil {
+		t.Fatal("Expected rejected entities to be reported")
+	}
+	if !strings.Contains(err.Error(), "2 entities were rejected") ||
+		!strings.Contains(err.Error(), "http://data.sample.org/things/3 (Neo4jError: Neo.ClientError.Statement.TypeError (unsupported property value))") {
+		t.Errorf("Unexpected error %s", err.Error())
+	}
+
+	if len(client.written) != 8 {
+		t.Errorf("Expected 8 entities written, got %d", len(client.written))
+	}
+	for i, entity := range client.written {
+		if client.poison[entity.ID] {
+			t.Errorf("Poison entity %s was written", entity.ID)
+		}
+		if i > 0 && entity.ID < client.written[i-1].ID {
+			t.Errorf("Expected entities to be written in order")
+		}
+	}
+}
+
+func TestWriterFailsBatchOnGraphErrors(t *testing.T) {
+	api := &fakeQueryAPI{}
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	clients := map[string]GraphQueryClient{
+		"wrong password": NewNeo4jClient(server.URL, "", Credentials{Username: "neo4j", Password: "rotated"}, cdl.NewLogger("test", "text", "info"), newTestMetrics()),
+		"unavailable":    NewNeo4jClient(unavailable.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics()).WithRetryPolicy(testRetryPolicy),
+	}
+	for name, client := range clients {
+		dir := t.TempDir()
+		deadLetters, _ := NewDeadLetterStore(&DeadLetterConfig{Type: DeadLetterTypeDirectory, Path: dir}, "people", client)
+		writer := &CypherDatasetWriter{ctx: context.Background(), logger: cdl.NewLogger("test", "text", "info"), metrics: newTestMetrics(), GraphQueryClient: client, datasetName: "people", label: "Person", BatchSize: 8, deadLetters: deadLetters}
+		for i := 0; i < 8; i++ {
+			_ = writer.Write(makeEntity(strconv.Itoa(i)))
+		}
+		err := writer.Close()
+		if err == nil || len(writer.rejected) != 0 {
+			t.Errorf("%s: expected the batch to fail without rejecting entities, got %v and %d rejected", name, err, len(writer.rejected))
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("%s: expected no dead letters, got %d files", name, len(entries))
+		}
+	}
+}
+
+func TestWriterFlushesOnBatchBytes(t *testing.T) {
+	client := &fakeQueryClient{}
+	data, _ := json.Marshal(makeEntity("1"))
+	writer := &CypherDatasetWriter{ctx: context.Background(), logger: cdl.NewLogger("test", "text", "info"), metrics: newTestMetrics(), GraphQueryClient: client, datasetName: "people", label: "Person", BatchSize: 100, MaxBatchBytes: len(data) * 5 / 2}
+
+	for i := 0; i < 6; i++ {
+		err := writer.Write(makeEntity(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if client.batches != 3 || len(client.written) != 6 {
+		t.Errorf("Expected 6 entities written in 3 batches, got %d in %d", len(client.written), client.batches)
+	}
+}
+
+func TestSyncStatsInMetaData(t *testing.T) {
+	client := &fakeQueryClient{}
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{"label": "Person", "batch_size": 2}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a full sync of two requests with three entities each
+	for i, batch := range []cdl.BatchInfo{{SyncId: "s1", IsStartBatch: true}, {SyncId: "s1", IsLastBatch: true}} {
+		writer, layerErr := ds.FullSync(context.Background(), batch)
+		if layerErr != nil {
+			t.Fatal(layerErr)
+		}
+		for j := 0; j < 3; j++ {
+			layerErr = writer.Write(makeEntity(strconv.Itoa(i*3 + j)))
+			if layerErr != nil {
+				t.Fatal(layerErr)
+			}
+		}
+		layerErr = writer.Close()
+		if layerErr != nil {
+			t.Fatal(layerErr)
+		}
+		if i == 0 && ds.MetaData()["runningFullSync"] == nil {
+			t.Error("Expected the running full sync in metadata")
+		}
+	}
+
+	lastSync, ok := ds.MetaData()["lastSync"].(SyncStats)
+	if !ok {
+		t.Fatal("Expected last sync in metadata")
+	}
+	if lastSync.SyncId != "s1" || lastSync.Type != SyncTypeFull || lastSync.Batches != 4 || lastSync.Entities != 6 || lastSync.NodesCreated != 6 {
+		t.Errorf("Unexpected last sync %+v", lastSync)
+	}
+	if ds.MetaData()["runningFullSync"] != nil {
+		t.Error("Expected no running full sync after the last batch")
+	}
+}
+
+func (c *fakeQueryClient) ExecuteStatement(ctx context.Context, source string, statement string, params map[string]any, options WriteOptions) (WriteStats, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.failOn != "" && strings.Contains(statement, c.failOn) {
+		return WriteStats{}, errors.New("statement failed")
+	}
+	c.statements = append(c.statements, statement)
+	c.params = params
+	return WriteStats{PropertiesSet: 1}, nil
+}
+
+func (c *fakeQueryClient) Explain(ctx context.Context, statement string) error {
+	return nil
+}
+
+func TestFailedSyncInMetaData(t *testing.T) {
+	client := &fakeQueryClient{unavailable: true}
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{"label": "Person", "batch_size": 2}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a full sync failing in a batch that is not the last one is completed with the error
+	writer, layerErr := ds.FullSync(context.Background(), cdl.BatchInfo{SyncId: "s1", IsStartBatch: true})
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	// batches are written in the background, the failure is returned by a later write
+	for i := 0; i < 10 && layerErr == nil; i++ {
+		layerErr = writer.Write(makeEntity(strconv.Itoa(i)))
+		time.Sleep(time.Millisecond)
+	}
+	if layerErr == nil {
+		t.Fatal("Expected a write to fail")
+	}
+	if writer.(*CypherDatasetWriter).ctx.Err() == nil {
+		t.Error("Expected the failed request to be cancelled, it is never closed")
+	}
+	lastSync, ok := ds.MetaData()["lastSync"].(SyncStats)
+	if !ok || lastSync.SyncId != "s1" || lastSync.Error == "" || ds.MetaData()["runningFullSync"] != nil {
+		t.Errorf("Expected the failed full sync as last sync, got %+v and %v", lastSync, ds.MetaData()["runningFullSync"])
+	}
+
+	// as is an incremental sync failing when it is closed
+	writer, _ = ds.Incremental(context.Background())
+	_ = writer.Write(makeEntity("3"))
+	if layerErr = writer.Close(); layerErr == nil {
+		t.Fatal("Expected close to fail")
+	}
+	lastSync = ds.MetaData()["lastSync"].(SyncStats)
+	if lastSync.Type != SyncTypeIncremental || !strings.Contains(lastSync.Error, "could not write batch") {
+		t.Errorf("Expected the failed incremental sync as last sync, got %+v", lastSync)
+	}
+}
+
+func (c *fakeQueryClient) CheckHealth(ctx context.Context, schemas []LabelSchema) *HealthStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return &HealthStatus{Graph: "default", Healthy: !c.unavailable, Checked: time.Now()}
+}
@@ -2,65 +2,172 @@ package layer
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	cdl "github.com/mimiro-io/common-datalayer"
 	egdm "github.com/mimiro-io/entity-graph-data-model"
 	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j/config"
+	"slices"
 	"strings"
 	"time"
 )
 
 type Neo4jClient struct {
-	endpoint string
-	username string
-	password string
-	realm    string
-	logger   cdl.Logger
+	endpoint    string
+	credentials Credentials
+	tls         *TLSConfig // optional ca, client certificate and server name for encrypted endpoints
+	database    string     // empty for the server default database
+	systemType  string
+	logger      cdl.Logger
+	metrics     cdl.Metrics
+	// retryPolicy applies to write transactions failing with transient errors
+	retryPolicy RetryPolicy
+	graph       string // name of the graph system in the config, used to tag metrics
+}
+
+// CypherTransport runs cypher statements in explicit transactions. The bolt driver and the
+// neo4j http query api both implement it so the client logic is shared between them.
+type CypherTransport interface {
+	// Run executes a statement in an auto-commit transaction
+	Run(ctx context.Context, query string, params map[string]any) error
+	// Collect executes a statement in an auto-commit transaction and returns the records keyed by column
+	Collect(ctx context.Context, query string, params map[string]any) ([]map[string]any, error)
+	BeginTransaction(ctx context.Context, timeout time.Duration) (CypherTransaction, error)
+	Close(ctx context.Context) error
+}
+
+type CypherTransaction interface {
+	Run(ctx context.Context, query string, params map[string]any) error
+	// Collect executes a statement in the transaction and returns the records keyed by column
+	Collect(ctx context.Context, query string, params map[string]any) ([]map[string]any, error)
+	Commit(ctx context.Context) error
+	// Close rolls back the transaction if it has not been committed
+	Close(ctx context.Context) error
+	// Stats returns the changes made by the statements run so far
+	Stats() WriteStats
 }
 
 const IndexQuery = "CREATE INDEX external_id_index_%s IF NOT EXISTS FOR (n:%s) ON (n.gid)"
 
-func (n *Neo4jClient) Initialise(datasets []string) error {
-	n.logger.Info("initialising neo4j client", "datasets", datasets)
-	driver, err := n.Connect()
+const MemgraphIndexQuery = "CREATE INDEX ON :%s(gid)"
+
+// timeout of index creation
+const DefaultLongTransactionTimeout = 15 * time.Minute
+
+func (n *Neo4jClient) Initialise(ctx context.Context, schemas []LabelSchema) error {
+	labels := make([]string, 0, len(schemas))
+	for _, schema := range schemas {
+		labels = append(labels, schema.Label)
+	}
+	n.logger.Info("initialising neo4j client", "database", n.database, "datasets", labels)
+	transport, err := n.Open(ctx)
 	if err != nil {
 		return err
 	}
+	defer transport.Close(ctx)
+
+	if n.systemType == SystemTypeMemgraph {
+		// memgraph does not allow index changes in explicit transactions
+		for _, schema := range schemas {
+			n.logger.Debug("creating index", "dataset", schema.Label)
+			err := transport.Run(ctx, fmt.Sprintf(MemgraphIndexQuery, schema.Label), nil)
+			if err != nil {
+				return err
+			}
+			for _, index := range schema.Indexes {
+				err := transport.Run(ctx, index.memgraphCreateStatement(schema.Label), nil)
+				if err != nil {
+					return fmt.Errorf("could not create index on %s(%s) because %s", schema.Label, strings.Join(index.Properties, ", "), err.Error())
+				}
+			}
+		}
+		return nil
+	}
 
-	ctx := context.Background()
-	defer driver.Close(ctx)
-
-	session := driver.NewSession(ctx, neo4j.SessionConfig{})
-	defer session.Close(ctx)
+	drops := make([]string, 0)
+	if slices.ContainsFunc(schemas, func(schema LabelSchema) bool { return schema.DropUnmanaged || len(schema.Indexes) > 0 }) {
+		drops, err = n.schemaDrops(ctx, transport, schemas)
+		if err != nil {
+			return err
+		}
+	}
 
-	txn, err := session.BeginTransaction(ctx, func(config *neo4j.TransactionConfig) { config.Timeout = 15 * time.Minute })
+	txn, err := transport.BeginTransaction(ctx, DefaultLongTransactionTimeout)
 	if err != nil {
 		return err
 	}
+	defer txn.Close(ctx)
 
-	for _, dataset := range datasets {
-		n.logger.Debug("creating index", "dataset", dataset)
-		res, err := txn.Run(ctx, fmt.Sprintf(IndexQuery, dataset, dataset), nil)
-		fmt.Println(res)
+	// unmanaged and changed indexes are dropped first, an existing one would make the create below a no-op
+	for _, drop := range drops {
+		n.logger.Info("dropping index", "statement", drop)
+		err := txn.Run(ctx, drop, nil)
+		if err != nil {
+			return fmt.Errorf("could not run %s because %s", drop, err.Error())
+		}
+	}
+
+	for _, schema := range schemas {
+		n.logger.Debug("creating index", "dataset", schema.Label)
+		err := txn.Run(ctx, fmt.Sprintf(IndexQuery, schema.Label, schema.Label), nil)
 		if err != nil {
 			return err
 		}
+		for _, index := range schema.Indexes {
+			err := txn.Run(ctx, index.createStatement(schema.Label), nil)
+			if err != nil {
+				return fmt.Errorf("could not create %s index %s because %s", index.indexType(), index.indexName(schema.Label), err.Error())
+			}
+		}
 	}
 
 	err = txn.Commit(ctx)
-
+	if err != nil {
+		return fmt.Errorf("could not commit index changes because %s", err.Error())
+	}
 	return nil
 }
 
-func NewNeo4jClient(endpoint string, username string, password string, logger cdl.Logger) *Neo4jClient {
+func NewNeo4jClient(endpoint string, database string, credentials Credentials, logger cdl.Logger, metrics cdl.Metrics) *Neo4jClient {
 	return &Neo4jClient{
-		endpoint: endpoint,
-		username: username,
-		password: password,
-		logger:   logger,
+		endpoint:    endpoint,
+		database:    database,
+		systemType:  SystemTypeNeo4j,
+		credentials: credentials,
+		logger:      logger,
+		metrics:     metrics,
+		retryPolicy: DefaultRetryPolicy(),
 	}
 }
 
+func (n *Neo4jClient) WithRetryPolicy(retryPolicy RetryPolicy) *Neo4jClient {
+	n.retryPolicy = retryPolicy
+	return n
+}
+
+func (n *Neo4jClient) WithTLS(tls *TLSConfig) *Neo4jClient {
+	n.tls = tls
+	return n
+}
+
+func (n *Neo4jClient) WithGraph(graph string) *Neo4jClient {
+	n.graph = graph
+	return n
+}
+
+func (n *Neo4jClient) tags(source string) []string {
+	return metricTags(source, n.graph)
+}
+
+// NewMemgraphClient creates a client for memgraph, which speaks bolt and cypher but has a single database
+// and its own index syntax
+func NewMemgraphClient(endpoint string, credentials Credentials, logger cdl.Logger, metrics cdl.Metrics) *Neo4jClient {
+	client := NewNeo4jClient(endpoint, "", credentials, logger, metrics)
+	client.systemType = SystemTypeMemgraph
+	return client
+}
+
 type Neo4jLogger struct {
 	logger cdl.Logger
 }
@@ -83,7 +190,20 @@ func (n *Neo4jLogger) Debug(name, msg string) {
 
 func (n *Neo4jClient) Connect() (neo4j.DriverWithContext, error) {
 	dbUri := n.endpoint // scheme://host(:port) (default port is 7687)
-	driver, err := neo4j.NewDriverWithContext(dbUri, neo4j.BasicAuth(n.username, n.password, n.realm))
+	tokenManager, err := n.credentials.tokenManager()
+	if err != nil {
+		return nil, err
+	}
+	configurers := make([]func(*config.Config), 0)
+	if n.tls != nil {
+		var tlsConfig *tls.Config
+		dbUri, tlsConfig, err = n.tls.boltTLS(dbUri)
+		if err != nil {
+			return nil, err
+		}
+		configurers = append(configurers, func(c *config.Config) { c.TlsConfig = tlsConfig })
+	}
+	driver, err := neo4j.NewDriverWithContext(dbUri, tokenManager, configurers...)
 	if err != nil {
 		n.logger.Error("Failed to connect to Neo4j", "error", err)
 		return nil, err
@@ -92,6 +212,147 @@ func (n *Neo4jClient) Connect() (neo4j.DriverWithContext, error) {
 	return driver, nil
 }
 
+// Open returns the transport matching the endpoint scheme, http(s) endpoints use the query api
+// and everything else goes through the bolt driver
+func (n *Neo4jClient) Open(ctx context.Context) (CypherTransport, error) {
+	if isHTTPEndpoint(n.endpoint) {
+		authorization, err := n.credentials.authorization()
+		if err != nil {
+			return nil, err
+		}
+		transport := NewHTTPTransport(n.endpoint, n.database, authorization)
+		if n.tls != nil {
+			tlsConfig, err := n.tls.Load()
+			if err != nil {
+				return nil, err
+			}
+			transport.WithTLS(tlsConfig)
+		}
+		return transport, nil
+	}
+
+	driver, err := n.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return &boltTransport{driver: driver, session: driver.NewSession(ctx, neo4j.SessionConfig{DatabaseName: n.database})}, nil
+}
+
+type boltTransport struct {
+	driver  neo4j.DriverWithContext
+	session neo4j.SessionWithContext
+}
+
+func (b *boltTransport) Run(ctx context.Context, query string, params map[string]any) error {
+	result, err := b.session.Run(ctx, query, params)
+	if err != nil {
+		return err
+	}
+	_, err = result.Consume(ctx)
+	return err
+}
+
+func (b *boltTransport) Collect(ctx context.Context, query string, params map[string]any) ([]map[string]any, error) {
+	result, err := b.session.Run(ctx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	records, err := result.Collect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return recordRows(records), nil
+}
+
+func recordRows(records []*neo4j.Record) []map[string]any {
+	rows := make([]map[string]any, 0, len(records))
+	for _, record := range records {
+		rows = append(rows, record.AsMap())
+	}
+	return rows
+}
+
+func (b *boltTransport) BeginTransaction(ctx context.Context, timeout time.Duration) (CypherTransaction, error) {
+	configurers := make([]func(*neo4j.TransactionConfig), 0)
+	if timeout > 0 {
+		configurers = append(configurers, func(config *neo4j.TransactionConfig) { config.Timeout = timeout })
+	}
+
+	txn, err := b.session.BeginTransaction(ctx, configurers...)
+	if err != nil {
+		return nil, err
+	}
+	return &boltTransaction{txn: txn}, nil
+}
+
+func (b *boltTransport) Close(ctx context.Context) error {
+	err := b.session.Close(ctx)
+	if err != nil {
+		b.driver.Close(ctx)
+		return err
+	}
+	return b.driver.Close(ctx)
+}
+
+type boltTransaction struct {
+	txn   neo4j.ExplicitTransaction
+	stats WriteStats
+}
+
+func (b *boltTransaction) Run(ctx context.Context, query string, params map[string]any) error {
+	result, err := b.txn.Run(ctx, query, params)
+	if err != nil {
+		return err
+	}
+	summary, err := result.Consume(ctx)
+	if err != nil {
+		return err
+	}
+	b.addStats(summary)
+	return nil
+}
+
+func (b *boltTransaction) Collect(ctx context.Context, query string, params map[string]any) ([]map[string]any, error) {
+	result, err := b.txn.Run(ctx, query, params)
+	if err != nil {
+		return nil, err
+	}
+	records, err := result.Collect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	summary, err := result.Consume(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.addStats(summary)
+	return recordRows(records), nil
+}
+
+func (b *boltTransaction) addStats(summary neo4j.ResultSummary) {
+	counters := summary.Counters()
+	b.stats.Add(WriteStats{
+		NodesCreated:         counters.NodesCreated(),
+		NodesDeleted:         counters.NodesDeleted(),
+		RelationshipsCreated: counters.RelationshipsCreated(),
+		RelationshipsDeleted: counters.RelationshipsDeleted(),
+		PropertiesSet:        counters.PropertiesSet(),
+		LabelsAdded:          counters.LabelsAdded(),
+	})
+}
+
+func (b *boltTransaction) Stats() WriteStats {
+	return b.stats
+}
+
+func (b *boltTransaction) Commit(ctx context.Context) error {
+	return b.txn.Commit(ctx)
+}
+
+func (b *boltTransaction) Close(ctx context.Context) error {
+	return b.txn.Close(ctx)
+}
+
 const DeleteNodeQueryTemplate = `
 UNWIND $items AS item
 MATCH (n {gid: item.gid})
@@ -122,10 +383,25 @@ SET r.source = item.source
 SET r.type = item.type
 `
 
-const DeleteAllBySourceAndLabelTemplate = `
-MATCH (n:%s {source: "%s"}) DETACH DELETE n
+// DeleteRelationshipsChunkTemplate removes up to $limit relationships of the dataset's nodes
+const DeleteRelationshipsChunkTemplate = `
+MATCH (n:%s {source: $source})-[r]-()
+WITH DISTINCT r LIMIT $limit
+DELETE r
+RETURN count(r) AS deleted
+`
+
+// DeleteNodesChunkTemplate removes up to $limit of the dataset's nodes
+const DeleteNodesChunkTemplate = `
+MATCH (n:%s {source: $source})
+WITH n LIMIT $limit
+DETACH DELETE n
+RETURN count(n) AS deleted
 `
 
+// default number of nodes or relationships removed per transaction when deleting a dataset
+const DefaultDeleteChunkSize = 10000
+
 // given a URI return the last part after # or /
 func stripPrefix(s string) string {
 	if i := strings.LastIndex(s, "#"); i != -1 {
@@ -137,45 +413,129 @@ func stripPrefix(s string) string {
 	return s
 }
 
-func (n *Neo4jClient) DeleteAll(source string, label string) error {
-	n.logger.Info("deleting all nodes", "source", source, "label", label)
-	driver, err := n.Connect()
-	if err != nil {
-		return err
+// nodeItem builds the property map stored on the node for an entity, converting the embeddings of
+// vectors to float lists
+func nodeItem(source string, entity *egdm.Entity, vectors map[string]int) (map[string]interface{}, error) {
+	itemMap := make(map[string]interface{})
+	itemMap["gid"] = entity.ID
+	itemMap["source"] = source
+	for k, v := range entity.Properties {
+		property := stripPrefix(k)
+		if dimensions, ok := vectors[property]; ok && v != nil {
+			vector, err := floatVector(v, dimensions)
+			if err != nil {
+				return nil, fmt.Errorf("embedding %s of entity %s %s", property, entity.ID, err.Error())
+			}
+			v = vector
+		}
+		itemMap[property] = v
 	}
-	ctx := context.Background()
-	defer driver.Close(ctx)
+	return itemMap, nil
+}
 
-	session := driver.NewSession(ctx, neo4j.SessionConfig{})
-	defer session.Close(ctx)
+// EntityError is returned when an entity of a batch cannot be converted to statement parameters
+type EntityError struct {
+	Err error
+}
 
-	txn, err := session.BeginTransaction(ctx, func(config *neo4j.TransactionConfig) { config.Timeout = 15 * time.Minute })
+func (e *EntityError) Error() string {
+	return e.Err.Error()
+}
 
-	if err != nil {
-		return err
+func (e *EntityError) Unwrap() error {
+	return e.Err
+}
+
+// referenceTargets returns the target ids of a reference value
+func referenceTargets(rel any) ([]string, error) {
+	related := make([]string, 0)
+	switch val := rel.(type) {
+	case string:
+		related = append(related, val)
+	case []string:
+		related = append(related, val...)
+	case []any:
+		// references read back from json, e.g. from the spool
+		for _, v := range val {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported type %T in reference list", v)
+			}
+			related = append(related, s)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %T", val)
 	}
+	return related, nil
+}
 
-	_, err = txn.Run(ctx, fmt.Sprintf(DeleteAllBySourceAndLabelTemplate, label, source), nil)
+// DeleteAll removes the dataset's nodes and their relationships in chunks, one transaction per chunk,
+// so that deleting a large dataset never needs the whole dataset in server memory. Relationships are
+// removed first so that the node chunks stay small for densely connected nodes.
+func (n *Neo4jClient) DeleteAll(ctx context.Context, source string, label string, options WriteOptions) error {
+	n.logger.Info("deleting all nodes", "source", source, "label", label)
+	chunkSize := options.DeleteChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultDeleteChunkSize
+	}
+
+	relationships, err := n.deleteInChunks(ctx, source, fmt.Sprintf(DeleteRelationshipsChunkTemplate, label), chunkSize, options, "relationships")
 	if err != nil {
 		return err
 	}
-
-	err = txn.Commit(ctx)
+	nodes, err := n.deleteInChunks(ctx, source, fmt.Sprintf(DeleteNodesChunkTemplate, label), chunkSize, options, "nodes")
 	if err != nil {
 		return err
 	}
 
+	n.logger.Info("deleted all nodes", "source", source, "label", label, "nodes", nodes, "relationships", relationships)
 	return nil
 }
 
-func (n *Neo4jClient) WriteBatch(source string, label string, entities []*egdm.Entity) error {
-	n.logger.Info("writing batch", "source", source, "label", label, "entities", len(entities))
-	driver, err := n.Connect()
-	if err != nil {
-		return err
+// deleteInChunks runs the chunk query until it deletes fewer items than the chunk size and returns
+// the total deleted
+func (n *Neo4jClient) deleteInChunks(ctx context.Context, source string, query string, chunkSize int, options WriteOptions, kind string) (int, error) {
+	total := 0
+	for {
+		deleted := 0
+		err := n.ExecuteWrite(ctx, source, options.TransactionTimeout, func(txn CypherTransaction) error {
+			ctx, span := n.startStatementSpan(ctx, "delete_"+kind, chunkSize)
+			rows, err := txn.Collect(ctx, query, map[string]any{"source": source, "limit": chunkSize})
+			if err == nil && len(rows) > 0 {
+				deleted = asInt(rows[0]["deleted"])
+			}
+			endSpan(span, err)
+			return err
+		})
+		if err != nil {
+			return total, fmt.Errorf("could not delete %s after removing %d because %w", kind, total, err)
+		}
+
+		total += deleted
+		addTotal(n.metrics, "opencypher.delete."+kind, n.tags(source), deleted)
+		n.logger.Info(fmt.Sprintf("deleted %d %s", total, kind), "source", source)
+		if deleted < chunkSize {
+			return total, nil
+		}
+	}
+}
+
+// asInt reads a count returned by either transport, bolt returns int64 and the query api float64
+func asInt(v any) int {
+	switch value := v.(type) {
+	case int64:
+		return int(value)
+	case float64:
+		return int(value)
+	case int:
+		return value
 	}
-	ctx := context.Background()
-	defer driver.Close(ctx)
+	return 0
+}
+
+// WriteBatch writes the entities in one transaction and returns the changes it made
+func (n *Neo4jClient) WriteBatch(ctx context.Context, source string, label string, entities []*egdm.Entity, options WriteOptions) (WriteStats, error) {
+	n.logger.Info("writing batch", "source", source, "label", label, "entities", len(entities))
 
 	// nodeItems for updates
 	deletedItems := make([]map[string]interface{}, 0)
@@ -189,22 +549,15 @@ func (n *Neo4jClient) WriteBatch(source string, label string, entities []*egdm.E
 			continue
 		}
 
-		itemMap := make(map[string]interface{})
-		itemMap["gid"] = entity.ID
-		itemMap["source"] = source
-		for k, v := range entity.Properties {
-			itemMap[stripPrefix(k)] = v
+		itemMap, err := nodeItem(source, entity, options.Vectors)
+		if err != nil {
+			return WriteStats{}, &EntityError{Err: err}
 		}
 
 		for property, rel := range entity.References {
-			related := make([]string, 0)
-			switch val := rel.(type) {
-			case string:
-				related = append(related, val)
-			case []string:
-				related = append(related, val...)
-			default:
-				return fmt.Errorf("unsupported type %T", val)
+			related, err := referenceTargets(rel)
+			if err != nil {
+				return WriteStats{}, &EntityError{Err: fmt.Errorf("reference %s of entity %s has %s", property, entity.ID, err.Error())}
 			}
 
 			for _, target := range related {
@@ -231,61 +584,89 @@ func (n *Neo4jClient) WriteBatch(source string, label string, entities []*egdm.E
 		nodeItems = append(nodeItems, itemMap)
 	}
 
-	// start a txn then using the templates do the needful
-	session := driver.NewSession(ctx, neo4j.SessionConfig{})
-	defer session.Close(ctx)
-
-	txn, err := session.BeginTransaction(ctx)
-	if err != nil {
-		return err
+	// make item list for the target nodes
+	targetItems := make([]map[string]any, 0)
+	for k := range listOfTargetNodes {
+		targetItems = append(targetItems, map[string]any{"gid": k})
 	}
 
-	// delete nodes
-	if len(deletedItems) > 0 {
-		_, err = txn.Run(ctx, DeleteNodeQueryTemplate, map[string]interface{}{"items": deletedItems})
-		if err != nil {
-			return err
+	// run a managed txn then using the templates do the needful
+	var stats WriteStats
+	start := time.Now()
+	err := n.ExecuteWrite(ctx, source, options.TransactionTimeout, func(txn CypherTransaction) error {
+		// delete nodes
+		if len(deletedItems) > 0 {
+			err := n.runStatement(ctx, txn, "delete_nodes", options.Templates.deleteNode(), deletedItems)
+			if err != nil {
+				return err
+			}
 		}
-	}
 
-	// update nodes
-	if len(nodeItems) > 0 {
-		_, err = txn.Run(ctx, fmt.Sprintf(UpdateNodeQueryTemplate, label), map[string]interface{}{"items": nodeItems})
-		if err != nil {
-			return err
+		// update nodes
+		if len(nodeItems) > 0 {
+			err := n.runStatement(ctx, txn, "update_nodes", options.Templates.updateNode(label), nodeItems)
+			if err != nil {
+				return err
+			}
 		}
-	}
 
-	// create target nodes
-	if len(listOfTargetNodes) > 0 {
-		// make item list
-		items := make([]map[string]any, 0)
-		for k := range listOfTargetNodes {
-			items = append(items, map[string]any{"gid": k})
+		// create target nodes
+		if len(targetItems) > 0 {
+			err := n.runStatement(ctx, txn, "target_nodes", TargetNodeQueryTemplate, targetItems)
+			if err != nil {
+				return err
+			}
 		}
 
-		_, err = txn.Run(ctx, TargetNodeQueryTemplate, map[string]interface{}{"items": items})
-		if err != nil {
-			return err
+		// update relationships, split into statements of at most MaxRelationshipsPerStatement
+		for rel, items := range relationshipsItems {
+			for _, chunk := range chunks(items, options.MaxRelationshipsPerStatement) {
+				err := n.runStatement(ctx, txn, "update_relationships", options.Templates.updateRelationship(stripPrefix(rel)), chunk)
+				if err != nil {
+					return err
+				}
+			}
 		}
+
+		// taken from the attempt that commits
+		stats = txn.Stats()
+		return nil
+	})
+	if err != nil {
+		return WriteStats{}, err
 	}
 
-	// update relationships
-	for rel, items := range relationshipsItems {
-		_, err = txn.Run(ctx, fmt.Sprintf(UpdateEdgeQueryTemplate, stripPrefix(rel)), map[string]interface{}{"items": items})
-		if err != nil {
-			return err
-		}
+	n.logger.Debug("wrote batch", append([]any{"source", source, "entities", len(entities)}, stats.logArgs()...)...)
+	tags := n.tags(source)
+	stats.emit(n.metrics, tags)
+	n.metrics.Incr("opencypher.write.batches", tags, 1)
+	addTotal(n.metrics, "opencypher.write.entities_deleted", tags, len(deletedItems))
+	n.metrics.Timing("opencypher.write.batch_latency", time.Since(start), tags, 1)
+	return stats, nil
+}
+
+// chunks splits items into slices of at most size items, a size of 0 keeps them together
+func chunks[T any](items []T, size int) [][]T {
+	if size <= 0 || len(items) <= size {
+		return [][]T{items}
 	}
+	result := make([][]T, 0, (len(items)+size-1)/size)
+	for start := 0; start < len(items); start += size {
+		result = append(result, items[start:min(start+size, len(items))])
+	}
+	return result
+}
 
-	err = txn.Commit(ctx)
+// Query runs a read statement and returns the records keyed by column
+func (n *Neo4jClient) Query(ctx context.Context, query string, params map[string]any) ([]map[string]any, error) {
+	transport, err := n.Open(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer transport.Close(ctx)
 
-	return nil
-}
-
-func (n *Neo4jClient) Query(query string) (interface{}, error) {
-	return nil, nil
+	ctx, span := n.startStatementSpan(ctx, "read", 0)
+	rows, err := transport.Collect(ctx, query, params)
+	endSpan(span, err)
+	return rows, err
 }
@@ -0,0 +1,245 @@
+package layer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// database used by the query api when none is configured, the bolt driver uses the server default instead
+const DefaultDatabase = "neo4j"
+
+// header used by neo4j clusters to route all requests of a transaction to the same server
+const clusterAffinityHeader = "neo4j-cluster-affinity"
+
+func isHTTPEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://")
+}
+
+// HTTPTransport runs cypher through the neo4j http query api. Server errors are returned as
+// neo4j.Neo4jError and network failures as neo4j.ConnectivityError so they are classified the
+// same way as errors from the bolt driver. The query api has no per transaction timeout, the
+// server side db.transaction.timeout applies instead.
+type HTTPTransport struct {
+	client        *http.Client
+	baseURL       string
+	database      string
+	authorization string // value of the Authorization header, empty for no auth
+}
+
+func NewHTTPTransport(endpoint string, database string, authorization string) *HTTPTransport {
+	if database == "" {
+		database = DefaultDatabase
+	}
+	return &HTTPTransport{
+		client:        &http.Client{},
+		baseURL:       strings.TrimSuffix(endpoint, "/"),
+		database:      database,
+		authorization: authorization,
+	}
+}
+
+// WithTLS sets the tls config of https connections
+func (h *HTTPTransport) WithTLS(tlsConfig *tls.Config) *HTTPTransport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	h.client.Transport = transport
+	return h
+}
+
+type queryRequest struct {
+	Statement  string         `json:"statement,omitempty"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+	Counters   bool           `json:"includeCounters,omitempty"`
+}
+
+type queryResponse struct {
+	Data struct {
+		Fields []string `json:"fields"`
+		Values [][]any  `json:"values"`
+	} `json:"data"`
+	Transaction *struct {
+		ID string `json:"id"`
+	} `json:"transaction"`
+	Counters *WriteStats `json:"counters"`
+	Errors   []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+func (h *HTTPTransport) txURL(parts ...string) string {
+	url := fmt.Sprintf("%s/db/%s/query/v2/tx", h.baseURL, h.database)
+	for _, part := range parts {
+		url += "/" + part
+	}
+	return url
+}
+
+// do sends a request to the query api and decodes the response, returning the cluster affinity
+// header so later requests in the same transaction reach the same server
+func (h *HTTPTransport) do(ctx context.Context, method string, url string, affinity string, body *queryRequest) (*queryResponse, string, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, "", err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if h.authorization != "" {
+		req.Header.Set("Authorization", h.authorization)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if affinity != "" {
+		req.Header.Set(clusterAffinityHeader, affinity)
+	}
+	// lets the server side of a traced statement join the trace
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, "", ctx.Err()
+		}
+		return nil, "", &neo4j.ConnectivityError{Inner: err}
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", &neo4j.ConnectivityError{Inner: err}
+	}
+
+	response := &queryResponse{}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, response)
+		if err != nil && res.StatusCode < 300 {
+			return nil, "", fmt.Errorf("could not decode query api response because %s", err.Error())
+		}
+	}
+
+	if len(response.Errors) > 0 {
+		return nil, "", &neo4j.Neo4jError{Code: response.Errors[0].Code, Msg: response.Errors[0].Message}
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, "", &neo4j.Neo4jError{Code: "Neo.ClientError.Security.Unauthorized", Msg: "invalid credentials"}
+	}
+
+	// overloaded servers and the proxies in front of them answer without a neo4j error, these are
+	// worth retrying like a lost connection
+	if res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusRequestTimeout {
+		return nil, "", &neo4j.ConnectivityError{Inner: fmt.Errorf("query api returned status %d: %s", res.StatusCode, string(data))}
+	}
+
+	if res.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("query api returned status %d: %s", res.StatusCode, string(data))
+	}
+
+	return response, res.Header.Get(clusterAffinityHeader), nil
+}
+
+func (h *HTTPTransport) Run(ctx context.Context, query string, params map[string]any) error {
+	_, err := h.Collect(ctx, query, params)
+	return err
+}
+
+func (h *HTTPTransport) Collect(ctx context.Context, query string, params map[string]any) ([]map[string]any, error) {
+	url := fmt.Sprintf("%s/db/%s/query/v2", h.baseURL, h.database)
+	response, _, err := h.do(ctx, http.MethodPost, url, "", &queryRequest{Statement: query, Parameters: params})
+	if err != nil {
+		return nil, err
+	}
+	return response.rows(), nil
+}
+
+// rows returns the records of the response keyed by column
+func (response *queryResponse) rows() []map[string]any {
+	rows := make([]map[string]any, 0, len(response.Data.Values))
+	for _, values := range response.Data.Values {
+		row := make(map[string]any, len(values))
+		for i, field := range response.Data.Fields {
+			if i < len(values) {
+				row[field] = values[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// BeginTransaction opens an explicit transaction, the query api has no per transaction timeout so the server setting applies
+func (h *HTTPTransport) BeginTransaction(ctx context.Context, timeout time.Duration) (CypherTransaction, error) {
+	response, affinity, err := h.do(ctx, http.MethodPost, h.txURL(), "", &queryRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if response.Transaction == nil || response.Transaction.ID == "" {
+		return nil, fmt.Errorf("query api did not return a transaction id")
+	}
+	return &httpTransaction{transport: h, id: response.Transaction.ID, affinity: affinity}, nil
+}
+
+func (h *HTTPTransport) Close(ctx context.Context) error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+type httpTransaction struct {
+	transport *HTTPTransport
+	id        string
+	affinity  string
+	done      bool
+	stats     WriteStats
+}
+
+func (t *httpTransaction) Run(ctx context.Context, query string, params map[string]any) error {
+	_, err := t.Collect(ctx, query, params)
+	return err
+}
+
+func (t *httpTransaction) Collect(ctx context.Context, query string, params map[string]any) ([]map[string]any, error) {
+	response, _, err := t.transport.do(ctx, http.MethodPost, t.transport.txURL(t.id), t.affinity, &queryRequest{Statement: query, Parameters: params, Counters: true})
+	if err != nil {
+		return nil, err
+	}
+	if response.Counters != nil {
+		t.stats.Add(*response.Counters)
+	}
+	return response.rows(), nil
+}
+
+func (t *httpTransaction) Stats() WriteStats {
+	return t.stats
+}
+
+func (t *httpTransaction) Commit(ctx context.Context) error {
+	t.done = true
+	_, _, err := t.transport.do(ctx, http.MethodPost, t.transport.txURL(t.id, "commit"), t.affinity, &queryRequest{})
+	return err
+}
+
+func (t *httpTransaction) Close(ctx context.Context) error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	_, _, err := t.transport.do(ctx, http.MethodDelete, t.transport.txURL(t.id), t.affinity, nil)
+	return err
+}
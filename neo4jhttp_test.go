@@ -0,0 +1,324 @@
+package layer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQueryAPI records the requests made against a minimal imitation of the neo4j query api
+type fakeQueryAPI struct {
+	lock       sync.Mutex
+	requests   []string
+	statements []string
+	failOn     string
+	failTimes  int    // number of times a statement matching failOn fails, 0 for always
+	failCode   string // error code of the failures, a deadlock when empty
+	failures   int
+	delay      time.Duration     // time each request takes unless it is cancelled
+	deleted    []int             // counts returned by successive delete chunk statements
+	results    map[string]string // data returned for statements containing the key
+	token      string            // bearer token accepted instead of basic auth when set
+}
+
+var testCredentials = Credentials{Username: "neo4j", Password: "secret"}
+
+var testRetryPolicy = RetryPolicy{MaxRetries: 2, InitialDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, MaxTime: time.Second}
+
+func (f *fakeQueryAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.delay > 0 {
+		// the server only notices a cancelled request once the body is read
+		data, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(f.delay):
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	user, password, _ := r.BasicAuth()
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token || f.token == "" && (user != "neo4j" || password != "secret") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	w.Header().Set(clusterAffinityHeader, "server-1")
+
+	body := &queryRequest{}
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(body)
+	}
+	if body.Statement != "" {
+		f.statements = append(f.statements, body.Statement)
+		if f.failOn != "" && strings.Contains(body.Statement, f.failOn) && (f.failTimes == 0 || f.failures < f.failTimes) {
+			f.failures++
+			code := f.failCode
+			if code == "" {
+				code = "Neo.TransientError.Transaction.DeadlockDetected"
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"errors":[{"code":"%s","message":"%s failed"}]}`, code, f.failOn)
+			return
+		}
+	}
+
+	for key, data := range f.results {
+		if body.Statement != "" && strings.Contains(body.Statement, key) {
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintf(w, `{"data":%s}`, data)
+			return
+		}
+	}
+
+	if strings.Contains(body.Statement, "AS deleted") && len(f.deleted) > 0 {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"data":{"fields":["deleted"],"values":[[%d]]},"transaction":{"id":"tx1"}}`, f.deleted[0])
+		f.deleted = f.deleted[1:]
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	if body.Counters && strings.Contains(body.Statement, "MERGE") {
+		w.Write([]byte(`{"data":{"fields":[],"values":[]},"counters":{"nodesCreated":1,"propertiesSet":3,"relationshipsCreated":1},"transaction":{"id":"tx1"}}`))
+		return
+	}
+	w.Write([]byte(`{"data":{"fields":[],"values":[]},"transaction":{"id":"tx1"}}`))
+}
+
+func TestHTTPTransportWriteBatch(t *testing.T) {
+	api := &fakeQueryAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	metrics := newTestMetrics()
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), metrics).WithRetryPolicy(testRetryPolicy)
+	stats, err := client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{makeEntity("1")}, WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each of the three statements reports one node, three properties and one relationship
+	if stats != (WriteStats{NodesCreated: 3, PropertiesSet: 9, RelationshipsCreated: 3}) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if metrics.gauge("opencypher.write.nodes_created") != 3 {
+		t.Errorf("Expected 3 nodes created in metrics, got %f", metrics.gauge("opencypher.write.nodes_created"))
+	}
+
+	expected := []string{
+		"POST /db/neo4j/query/v2/tx",
+		"POST /db/neo4j/query/v2/tx/tx1",
+		"POST /db/neo4j/query/v2/tx/tx1",
+		"POST /db/neo4j/query/v2/tx/tx1",
+		"POST /db/neo4j/query/v2/tx/tx1/commit",
+	}
+	if strings.Join(api.requests, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected requests %v", api.requests)
+	}
+	if len(api.statements) != 3 {
+		t.Errorf("Expected 3 statements, got %d", len(api.statements))
+	}
+}
+
+func TestHTTPTransportErrors(t *testing.T) {
+	api := &fakeQueryAPI{failOn: "MERGE (n1)"}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	metrics := newTestMetrics()
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), metrics).WithRetryPolicy(testRetryPolicy).WithGraph("analytics")
+	_, err := client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{makeEntity("1")}, WriteOptions{})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if metrics.count("opencypher.write.errors#category:transient") != 1 || metrics.count("opencypher.write.retries#graph:analytics") != 2 {
+		t.Errorf("Expected a transient error after 2 retries on graph analytics, got %v", metrics.counters)
+	}
+	var neo4jErr *neo4j.Neo4jError
+	if !errors.As(err, &neo4jErr) || !neo4j.IsRetryable(err) {
+		t.Errorf("Expected retryable neo4j error, got %v", err)
+	}
+	if api.failures != 3 {
+		t.Errorf("Expected 3 attempts, got %d", api.failures)
+	}
+	if api.requests[len(api.requests)-1] != "DELETE /db/neo4j/query/v2/tx/tx1" {
+		t.Errorf("Expected transaction to be rolled back, got %v", api.requests)
+	}
+
+	client = NewNeo4jClient(server.URL, "", Credentials{Username: "neo4j", Password: "wrong"}, cdl.NewLogger("test", "text", "info"), metrics).WithRetryPolicy(testRetryPolicy)
+	_, err = client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{makeEntity("1")}, WriteOptions{})
+	if !errors.As(err, &neo4jErr) || !neo4jErr.IsAuthenticationFailed() {
+		t.Errorf("Expected authentication error, got %v", err)
+	}
+	if metrics.count("opencypher.write.errors#category:client") != 1 {
+		t.Errorf("Expected a client error, got %v", metrics.counters)
+	}
+
+	// status pages from proxies and overloaded servers are retried
+	for _, status := range []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusRequestTimeout} {
+		attempts := 0
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts <= 2 {
+				w.WriteHeader(status)
+				w.Write([]byte("<html>try again later</html>"))
+				return
+			}
+			api.ServeHTTP(w, r)
+		}))
+		api.failOn = ""
+		client = NewNeo4jClient(proxy.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics()).WithRetryPolicy(testRetryPolicy)
+		_, err = client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{makeEntity("1")}, WriteOptions{})
+		if err != nil {
+			t.Errorf("Expected status %d to be retried, got %v", status, err)
+		}
+
+		attempts = -10
+		_, err = client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{makeEntity("1")}, WriteOptions{})
+		var connectivityErr *neo4j.ConnectivityError
+		if !errors.As(err, &connectivityErr) || !neo4j.IsRetryable(connectivityErr) {
+			t.Errorf("Expected retryable connectivity error for status %d, got %v", status, err)
+		}
+		proxy.Close()
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	api := &fakeQueryAPI{failOn: "MERGE (n1)", failTimes: 2}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	metrics := newTestMetrics()
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), metrics).WithRetryPolicy(testRetryPolicy)
+	_, err := client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{makeEntity("1")}, WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metrics.count("opencypher.write.retries") != 2 {
+		t.Errorf("Expected 2 retries, got %d", metrics.count("opencypher.write.retries"))
+	}
+	if api.requests[len(api.requests)-1] != "POST /db/neo4j/query/v2/tx/tx1/commit" {
+		t.Errorf("Expected last attempt to commit, got %v", api.requests)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 10, InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, MaxTime: time.Minute}
+	for retry, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 8: time.Second} {
+		delay := policy.delay(retry)
+		if delay < max/2 || delay > max {
+			t.Errorf("Expected delay for retry %d between %s and %s, got %s", retry, max/2, max, delay)
+		}
+	}
+}
+
+func TestCancelStopsDatabaseWork(t *testing.T) {
+	api := &fakeQueryAPI{delay: time.Minute}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics()).WithRetryPolicy(testRetryPolicy)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := client.DeleteAll(ctx, "people", "Person", WriteOptions{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Expected delete to stop at the deadline, took %s", time.Since(start))
+	}
+
+	// stopping a dataset aborts the writes of its open writers
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{"label": "Person", "batch_size": 1}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, layerErr := ds.Incremental(context.Background())
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	layerErr = writer.Write(makeEntity("1"))
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	time.AfterFunc(50*time.Millisecond, ds.Stop)
+	if writer.Close() == nil {
+		t.Error("Expected close to fail when the dataset is stopped")
+	}
+}
+
+func TestSplitRelationshipStatements(t *testing.T) {
+	api := &fakeQueryAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	entity := makeEntity("1")
+	entity.SetReference("http://data.sample.org/knows", []string{"a", "b", "c", "d", "e"})
+
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	_, err := client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{entity}, WriteOptions{MaxRelationshipsPerStatement: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	knows := 0
+	for _, statement := range api.statements {
+		if strings.Contains(statement, "[r:knows]") {
+			knows++
+		}
+	}
+	if knows != 3 {
+		t.Errorf("Expected 5 relationships in 3 statements, got %d statements", knows)
+	}
+}
+
+func TestDeleteAllInChunks(t *testing.T) {
+	// two chunks of relationships, then three of nodes
+	api := &fakeQueryAPI{deleted: []int{2, 1, 2, 2, 0}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	metrics := newTestMetrics()
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), metrics)
+	err := client.DeleteAll(context.Background(), "people", "Person", WriteOptions{DeleteChunkSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(api.deleted) != 0 {
+		t.Errorf("Expected all chunks to be deleted, %d left", len(api.deleted))
+	}
+	if metrics.gauge("opencypher.delete.relationships") != 3 || metrics.gauge("opencypher.delete.nodes") != 4 {
+		t.Errorf("Expected 3 relationships and 4 nodes deleted, got %f and %f",
+			metrics.gauge("opencypher.delete.relationships"), metrics.gauge("opencypher.delete.nodes"))
+	}
+	commits := 0
+	for _, request := range api.requests {
+		if strings.HasSuffix(request, "/commit") {
+			commits++
+		}
+	}
+	if commits != 5 {
+		t.Errorf("Expected a transaction per chunk, got %d commits", commits)
+	}
+}
@@ -0,0 +1,120 @@
+package layer
+
+import (
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"sync"
+)
+
+// default number of batches written concurrently by a dataset writer
+const DefaultWriteWorkers = 1
+
+// writePipeline hands batches to a bounded number of concurrent writers. A batch writing or referencing
+// a node that an earlier running batch writes or references waits until that batch is done, so later
+// versions of an entity never land before earlier ones and concurrent merges never create the same node
+// twice. The first error fails the pipeline, it is returned by the next submit and by wait.
+type writePipeline struct {
+	workers  int
+	write    func(entities []*egdm.Entity) error
+	lock     sync.Mutex
+	done     *sync.Cond // signalled whenever a batch finishes
+	running  int
+	inFlight map[string]int // ids of the nodes written or referenced by the running batches
+	err      error
+}
+
+func newWritePipeline(workers int, write func(entities []*egdm.Entity) error) *writePipeline {
+	p := &writePipeline{workers: workers, write: write, inFlight: make(map[string]int)}
+	p.done = sync.NewCond(&p.lock)
+	return p
+}
+
+// submit starts writing the batch in the background, blocking while all workers are busy or while an
+// earlier batch touching one of the same nodes is running
+func (p *writePipeline) submit(entities []*egdm.Entity) error {
+	ids := nodeIds(entities)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for p.err == nil && (p.running >= p.workers || p.conflicts(ids)) {
+		p.done.Wait()
+	}
+	if p.err != nil {
+		return p.err
+	}
+
+	for _, id := range ids {
+		p.inFlight[id]++
+	}
+	p.running++
+
+	go func() {
+		err := p.write(entities)
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		for _, id := range ids {
+			p.inFlight[id]--
+			if p.inFlight[id] == 0 {
+				delete(p.inFlight, id)
+			}
+		}
+		p.running--
+		if err != nil && p.err == nil {
+			p.err = err
+		}
+		p.done.Broadcast()
+	}()
+	return nil
+}
+
+func (p *writePipeline) conflicts(ids []string) bool {
+	if len(p.inFlight) == 0 {
+		return false
+	}
+	for _, id := range ids {
+		if p.inFlight[id] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeIds returns the ids of the entities and of the targets they reference, each once
+func nodeIds(entities []*egdm.Entity) []string {
+	seen := make(map[string]bool, len(entities))
+	ids := make([]string, 0, len(entities))
+	add := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	for _, entity := range entities {
+		add(entity.ID)
+		for _, rel := range entity.References {
+			// unsupported values are rejected when the batch is written
+			targets, _ := referenceTargets(rel)
+			for _, target := range targets {
+				add(target)
+			}
+		}
+	}
+	return ids
+}
+
+// failed returns the error of a failed batch, if any
+func (p *writePipeline) failed() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.err
+}
+
+// wait blocks until all submitted batches are written
+func (p *writePipeline) wait() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for p.running > 0 {
+		p.done.Wait()
+	}
+	return p.err
+}
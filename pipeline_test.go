@@ -0,0 +1,137 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPipelineKeepsEntityOrder(t *testing.T) {
+	client := &fakeQueryClient{delay: func(entities []*egdm.Entity) time.Duration {
+		// earlier versions take longer, so they would land last without ordering
+		version := entities[0].Properties["http://data.sample.org/version"].(int)
+		return time.Duration(10-version) * 5 * time.Millisecond
+	}}
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{
+		"label":         "Person",
+		"batch_size":    1,
+		"write_workers": 4,
+	}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, layerErr := ds.Incremental(context.Background())
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	ids := []string{"a", "b", "a", "c", "d", "a", "e", "f"}
+	for version, id := range ids {
+		entity := makeEntity(id)
+		entity.References = map[string]any{}
+		entity.SetProperty("http://data.sample.org/version", version)
+		layerErr = writer.Write(entity)
+		if layerErr != nil {
+			t.Fatal(layerErr)
+		}
+	}
+	layerErr = writer.Close()
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+
+	if len(client.written) != len(ids) {
+		t.Fatalf("Expected %d entities written, got %d", len(ids), len(client.written))
+	}
+	if client.maxRunning < 2 || client.maxRunning > 4 {
+		t.Errorf("Expected between 2 and 4 concurrent batches, got %d", client.maxRunning)
+	}
+	versions := make([]int, 0)
+	for _, entity := range client.written {
+		if entity.ID == "http://data.sample.org/things/a" {
+			versions = append(versions, entity.Properties["http://data.sample.org/version"].(int))
+		}
+	}
+	if len(versions) != 3 || versions[0] != 0 || versions[1] != 2 || versions[2] != 5 {
+		t.Errorf("Expected versions of a in order 0, 2, 5, got %v", versions)
+	}
+}
+
+func TestPipelineSurfacesErrors(t *testing.T) {
+	client := &fakeQueryClient{unavailable: true}
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{
+		"label":         "Person",
+		"batch_size":    1,
+		"write_workers": 2,
+	}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, layerErr := ds.Incremental(context.Background())
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+
+	// the first failure is returned by a later write, or by close at the latest
+	failed := false
+	for i := 0; i < 10 && !failed; i++ {
+		failed = writer.Write(makeEntity(strconv.Itoa(i))) != nil
+		time.Sleep(time.Millisecond)
+	}
+	if !failed {
+		t.Error("Expected a write to fail after a batch failed")
+	}
+	if writer.Close() == nil {
+		t.Error("Expected close to fail after a batch failed")
+	}
+}
+
+func TestPipelineSerialisesSharedNodes(t *testing.T) {
+	var lock sync.Mutex
+	running := make(map[string]bool)
+	overlaps := make([]string, 0)
+	pipeline := newWritePipeline(4, func(entities []*egdm.Entity) error {
+		id := entities[0].ID
+		lock.Lock()
+		for other := range running {
+			overlaps = append(overlaps, other+"+"+id)
+		}
+		running[id] = true
+		lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		lock.Lock()
+		delete(running, id)
+		lock.Unlock()
+		return nil
+	})
+
+	// a and b reference the same target, c is that target and d shares nothing. submit blocks on a
+	// conflict, so d goes before them to run alongside a.
+	a, b, c, d := makeEntity("a"), makeEntity("b"), makeEntity("mimiro"), makeEntity("d")
+	c.References = map[string]any{}
+	d.References = map[string]any{}
+	for _, entity := range []*egdm.Entity{a, d, b, c} {
+		if err := pipeline.submit([]*egdm.Entity{entity}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pipeline.wait(); err != nil {
+		t.Fatal(err)
+	}
+	for _, overlap := range overlaps {
+		if !strings.Contains(overlap, "things/d") {
+			t.Errorf("Expected batches sharing a node to run one at a time, got %s", overlap)
+		}
+	}
+	if len(overlaps) == 0 {
+		t.Error("Expected the unrelated batch to run concurrently")
+	}
+}
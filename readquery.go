@@ -0,0 +1,245 @@
+package layer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j/dbtype"
+	"slices"
+	"strings"
+)
+
+// ReadQueryConfig defines the entities of a dataset by a cypher query. The query is paged with the
+// parameters $continuation, null for the first page, and $limit.
+type ReadQueryConfig struct {
+	Query            string   `json:"query"`             // returns one row, or one node, per entity
+	IdColumn         string   `json:"id_column"`         // column or node property holding the entity id, defaults to gid
+	TokenColumn      string   `json:"token_column"`      // column whose value in the last row of a page continues the next one, defaults to the id column
+	ReferenceColumns []string `json:"reference_columns"` // columns holding the ids of related entities
+	Namespace        string   `json:"namespace"`         // expansion of the column names, and of ids that are not uris
+}
+
+func (r *ReadQueryConfig) idColumn() string {
+	if r.IdColumn == "" {
+		return "gid"
+	}
+	return r.IdColumn
+}
+
+func (r *ReadQueryConfig) tokenColumn() string {
+	if r.TokenColumn == "" {
+		return r.idColumn()
+	}
+	return r.TokenColumn
+}
+
+// keys that only apply to datasets written to a label
+var writeOnlyKeys = []string{"full_sync_mode", "bulk_import_dir", "dead_letter", "spool_dir", "indexes", "drop_unmanaged_indexes", "hooks", "write_templates"}
+
+// checkReadQuery adds a problem for each part of the read query that cannot be used
+func checkReadQuery(r *ReadQueryConfig, sourceConfig map[string]any, label string, problems *configProblems) {
+	if strings.TrimSpace(r.Query) == "" {
+		problems.add("no read_query.query specified")
+	} else if !strings.Contains(r.Query, "$continuation") || !strings.Contains(r.Query, "$limit") {
+		problems.add("read_query.query must use $continuation and $limit")
+	}
+	if !strings.HasSuffix(r.Namespace, "/") && !strings.HasSuffix(r.Namespace, "#") {
+		problems.add("read_query.namespace must end with / or #")
+	}
+	if label == "" {
+		for _, key := range writeOnlyKeys {
+			if _, ok := sourceConfig[key]; ok {
+				problems.add("%s is only used by datasets with a label", key)
+			}
+		}
+	}
+}
+
+// Entities pages through the read query, a limit of 0 reads all pages
+func (f *GraphDataset) Entities(from string, limit int) (cdl.EntityIterator, cdl.LayerError) {
+	f.logger.Info(fmt.Sprintf("get entities for dataset %s", f.name))
+	if f.config.ReadQuery == nil {
+		return nil, cdl.Err(fmt.Errorf("operation not supported"), cdl.LayerNotSupported)
+	}
+	namespaces := egdm.NewContext()
+	namespaces.Namespaces["ns0"] = f.config.ReadQuery.Namespace
+	return &queryEntityIterator{dataset: f, limit: limit, token: from, context: namespaces}, nil
+}
+
+// readOnly is the error for writes to a dataset defined only by its read query
+func (f *GraphDataset) readOnly() cdl.LayerError {
+	return cdl.Err(fmt.Errorf("dataset %s is read only", f.name), cdl.LayerNotSupported)
+}
+
+// queryEntityIterator reads the entities of a read query one page at a time
+type queryEntityIterator struct {
+	dataset   *GraphDataset
+	context   *egdm.Context
+	limit     int // entities to return, 0 for all
+	token     string
+	fetched   *string // token the last page was read from
+	page      []map[string]any
+	read      int
+	exhausted bool
+}
+
+func (q *queryEntityIterator) Context() *egdm.Context {
+	return q.context
+}
+
+func (q *queryEntityIterator) Next() (*egdm.Entity, cdl.LayerError) {
+	if len(q.page) == 0 {
+		if q.exhausted || q.limit > 0 && q.read >= q.limit {
+			return nil, nil
+		}
+		if q.fetched != nil && *q.fetched == q.token {
+			// rows without a token would read the same page forever
+			return nil, cdl.Err(fmt.Errorf("read query for dataset %s did not advance the continuation token", q.dataset.name), cdl.LayerErrorInternal)
+		}
+		err := q.fetch()
+		if err != nil {
+			return nil, cdl.Err(err, cdl.LayerErrorInternal)
+		}
+		if len(q.page) == 0 {
+			return nil, nil
+		}
+	}
+	// the token is read from the same columns as the entity, the properties of a node column
+	row := q.dataset.config.ReadQuery.columns(q.page[0])
+	q.page = q.page[1:]
+	q.read++
+
+	entity, err := q.dataset.config.ReadQuery.entity(row)
+	if err != nil {
+		return nil, cdl.Err(err, cdl.LayerErrorInternal)
+	}
+	if token, ok := row[q.dataset.config.ReadQuery.tokenColumn()]; ok && token != nil {
+		// the token keeps the type of the value, so that numbers compare as numbers in the query
+		data, err := json.Marshal(token)
+		if err != nil {
+			return nil, cdl.Err(fmt.Errorf("could not encode continuation token because %s", err.Error()), cdl.LayerErrorInternal)
+		}
+		q.token = string(data)
+	}
+	return entity, nil
+}
+
+// fetch reads the page following the current token
+func (q *queryEntityIterator) fetch() error {
+	pageSize := q.dataset.config.BatchSize
+	if q.limit > 0 {
+		pageSize = min(pageSize, q.limit-q.read)
+	}
+	var continuation any
+	if q.token != "" {
+		continuation = decodeToken(q.token)
+	}
+	from := q.token
+	q.fetched = &from
+
+	ctx, cancel := q.dataset.withStop(context.Background())
+	defer cancel()
+	rows, err := q.dataset.queryClient.Query(ctx, q.dataset.config.ReadQuery.Query, map[string]any{"continuation": continuation, "limit": pageSize})
+	if err != nil {
+		return fmt.Errorf("could not run read query for dataset %s because %s", q.dataset.name, err.Error())
+	}
+	q.page = rows
+	q.exhausted = len(rows) < pageSize
+	addTotal(q.dataset.metrics, "opencypher.read.entities", q.dataset.tags, len(rows))
+	return nil
+}
+
+// decodeToken returns the value held by a continuation token, tokens that are not json are strings
+func decodeToken(token string) any {
+	decoder := json.NewDecoder(strings.NewReader(token))
+	decoder.UseNumber()
+	var value any
+	if decoder.Decode(&value) != nil || decoder.More() {
+		return token
+	}
+	if number, ok := value.(json.Number); ok {
+		if i, err := number.Int64(); err == nil {
+			return i
+		}
+		f, _ := number.Float64()
+		return f
+	}
+	return value
+}
+
+func (q *queryEntityIterator) Token() (*egdm.Continuation, cdl.LayerError) {
+	continuation := egdm.NewContinuation()
+	continuation.Token = q.token
+	return continuation, nil
+}
+
+func (q *queryEntityIterator) Close() cdl.LayerError {
+	return nil
+}
+
+// columns returns the properties of the node in a row holding a single node, and other rows as they are
+func (r *ReadQueryConfig) columns(row map[string]any) map[string]any {
+	if len(row) == 1 {
+		for _, value := range row {
+			if properties, ok := nodeProperties(value); ok {
+				return properties
+			}
+		}
+	}
+	return row
+}
+
+// entity maps the columns of a row to an entity
+func (r *ReadQueryConfig) entity(row map[string]any) (*egdm.Entity, error) {
+	id, ok := row[r.idColumn()].(string)
+	if !ok || id == "" {
+		return nil, fmt.Errorf("read query row has no %s", r.idColumn())
+	}
+	entity := egdm.NewEntity().SetID(r.expand(id))
+	for column, value := range row {
+		if column == r.idColumn() || value == nil {
+			continue
+		}
+		if !slices.Contains(r.ReferenceColumns, column) {
+			entity.SetProperty(r.Namespace+column, value)
+			continue
+		}
+		targets, err := referenceTargets(value)
+		if err != nil {
+			return nil, fmt.Errorf("reference column %s of entity %s has %s", column, id, err.Error())
+		}
+		for i := range targets {
+			targets[i] = r.expand(targets[i])
+		}
+		if len(targets) == 1 {
+			entity.SetReference(r.Namespace+column, targets[0])
+		} else {
+			entity.SetReference(r.Namespace+column, targets)
+		}
+	}
+	return entity, nil
+}
+
+// expand prefixes ids that are not uris with the namespace
+func (r *ReadQueryConfig) expand(id string) string {
+	if strings.Contains(id, "://") {
+		return id
+	}
+	return r.Namespace + id
+}
+
+// nodeProperties returns the properties of a node read over bolt or the query api
+func nodeProperties(value any) (map[string]any, bool) {
+	switch node := value.(type) {
+	case dbtype.Node:
+		return node.Props, true
+	case map[string]any:
+		properties, ok := node["properties"].(map[string]any)
+		_, hasLabels := node["labels"]
+		_, hasElementId := node["elementId"]
+		return properties, ok && hasLabels && hasElementId
+	}
+	return nil, false
+}
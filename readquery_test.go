@@ -0,0 +1,131 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j/dbtype"
+	"strconv"
+	"testing"
+)
+
+func TestReadQueryEntities(t *testing.T) {
+	client := &fakeQueryClient{}
+	for i := 1; i <= 5; i++ {
+		client.rows = append(client.rows, map[string]any{"gid": "http://data.sample.org/things/" + strconv.Itoa(i), "community": int64(i % 2), "members": []any{"p1", "http://data.sample.org/things/p2"}})
+	}
+	definition := &cdl.DatasetDefinition{DatasetName: "communities", SourceConfig: map[string]any{
+		"batch_size": 2,
+		"read_query": map[string]any{
+			"query":             "MATCH (c:Community) WHERE $continuation IS NULL OR c.gid > $continuation RETURN c.gid AS gid ORDER BY gid LIMIT $limit",
+			"reference_columns": []any{"members"},
+			"namespace":         "http://data.sample.org/graph/",
+		},
+	}}
+	ds, err := NewGraphDataset("communities", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all entities are read in pages of batch_size
+	iterator, layerErr := ds.Entities("", 0)
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	ids := make([]string, 0)
+	for {
+		entity, layerErr := iterator.Next()
+		if layerErr != nil {
+			t.Fatal(layerErr)
+		}
+		if entity == nil {
+			break
+		}
+		ids = append(ids, entity.ID)
+		if entity.Properties["http://data.sample.org/graph/community"] == nil {
+			t.Errorf("Expected community property on %s", entity.ID)
+		}
+		members := entity.References["http://data.sample.org/graph/members"].([]string)
+		if members[0] != "http://data.sample.org/graph/p1" || members[1] != "http://data.sample.org/things/p2" {
+			t.Errorf("Unexpected members %v", members)
+		}
+	}
+	if len(ids) != 5 || ids[4] != "http://data.sample.org/things/5" {
+		t.Errorf("Expected 5 entities, got %v", ids)
+	}
+
+	// a limited read continues from the token
+	iterator, _ = ds.Entities("http://data.sample.org/things/1", 3)
+	count := 0
+	for entity, _ := iterator.Next(); entity != nil; entity, _ = iterator.Next() {
+		count++
+	}
+	token, _ := iterator.Token()
+	if count != 3 || token.Token != `"http://data.sample.org/things/4"` {
+		t.Errorf("Expected 3 entities up to things/4, got %d and %s", count, token.Token)
+	}
+
+	// numeric tokens keep their type, so the next page is read after the same number
+	client.pageBy = "rank"
+	for i, row := range client.rows {
+		row["rank"] = int64(1000000 * (i + 1))
+	}
+	definition.SourceConfig["read_query"].(map[string]any)["token_column"] = "rank"
+	ds, _ = NewGraphDataset("communities", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	iterator, _ = ds.Entities("", 2)
+	for entity, _ := iterator.Next(); entity != nil; entity, _ = iterator.Next() {
+	}
+	token, _ = iterator.Token()
+	if token.Token != "2000000" {
+		t.Errorf("Expected integer token 2000000, got %s", token.Token)
+	}
+	iterator, _ = ds.Entities(token.Token, 0)
+	count = 0
+	for entity, _ := iterator.Next(); entity != nil; entity, _ = iterator.Next() {
+		count++
+	}
+	if count != 3 {
+		t.Errorf("Expected the 3 entities after rank 2000000, got %d", count)
+	}
+
+	// a single node column is read as its properties, and is paged by them
+	client.pageBy = ""
+	client.rows = nil
+	for i := 1; i <= 5; i++ {
+		client.rows = append(client.rows, map[string]any{"n": dbtype.Node{Props: map[string]any{"gid": "x" + strconv.Itoa(i), "name": "brian"}}})
+	}
+	definition.SourceConfig["read_query"] = map[string]any{
+		"query":     "MATCH (n:Person) WHERE $continuation IS NULL OR n.gid > $continuation RETURN n ORDER BY n.gid LIMIT $limit",
+		"namespace": "http://data.sample.org/graph/",
+	}
+	ds, _ = NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	iterator, _ = ds.Entities("", 0)
+	ids = ids[:0]
+	for {
+		entity, layerErr := iterator.Next()
+		if layerErr != nil {
+			t.Fatal(layerErr)
+		}
+		if entity == nil {
+			break
+		}
+		ids = append(ids, entity.ID)
+		if entity.Properties["http://data.sample.org/graph/name"] != "brian" {
+			t.Errorf("Unexpected entity %+v", entity)
+		}
+	}
+	token, _ = iterator.Token()
+	if len(ids) != 5 || ids[0] != "http://data.sample.org/graph/x1" || token.Token != `"x5"` {
+		t.Errorf("Expected the 5 nodes paged by gid, got %v and token %s", ids, token.Token)
+	}
+
+	// read only datasets refuse writes
+	_, layerErr = ds.Incremental(context.Background())
+	if layerErr == nil || layerErr.Error() != "dataset people is read only" {
+		t.Errorf("Expected read only dataset, got %v", layerErr)
+	}
+
+	_, err = NewGraphDatasetConfig(map[string]any{"spool_dir": "/tmp", "read_query": map[string]any{"query": "MATCH (n) RETURN n", "namespace": "ns"}})
+	if err == nil || err.Error() != "read_query.query must use $continuation and $limit; read_query.namespace must end with / or #; spool_dir is only used by datasets with a label" {
+		t.Errorf("Unexpected validation %v", err)
+	}
+}
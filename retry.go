@@ -0,0 +1,203 @@
+package layer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls how writes failing with transient errors are retried
+type RetryPolicy struct {
+	MaxRetries   int           // retries after the first attempt
+	InitialDelay time.Duration // delay before the first retry, doubled for each further retry
+	MaxDelay     time.Duration // upper bound for the delay between retries
+	MaxTime      time.Duration // total time budget for all attempts
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:   5,
+		InitialDelay: 200 * time.Millisecond,
+		MaxDelay:     10 * time.Second,
+		MaxTime:      2 * time.Minute,
+	}
+}
+
+// NewRetryPolicy reads the retry settings from a graph system config, falling back to the defaults
+func NewRetryPolicy(config map[string]any) (RetryPolicy, error) {
+	policy := DefaultRetryPolicy()
+
+	if config["max_retries"] != nil {
+		maxRetries, ok := config["max_retries"].(float64)
+		if !ok || maxRetries < 0 {
+			return policy, fmt.Errorf("max_retries must be a non-negative number")
+		}
+		policy.MaxRetries = int(maxRetries)
+	}
+
+	durations := map[string]*time.Duration{
+		"retry_initial_delay": &policy.InitialDelay,
+		"retry_max_delay":     &policy.MaxDelay,
+		"retry_max_time":      &policy.MaxTime,
+	}
+	for key, target := range durations {
+		if config[key] == nil {
+			continue
+		}
+		value, ok := config[key].(string)
+		if !ok {
+			return policy, fmt.Errorf("%s must be a duration such as 500ms or 1m", key)
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return policy, fmt.Errorf("%s must be a duration such as 500ms or 1m", key)
+		}
+		*target = duration
+	}
+
+	return policy, nil
+}
+
+// delay returns the wait before the given retry, using exponential backoff with equal jitter
+func (p RetryPolicy) delay(retry int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// isTransient reports whether err, or an error it wraps, is one the graph may recover from when retried
+func isTransient(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if neo4j.IsRetryable(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEntityError reports whether err may be caused by the content of an entity, so that the entity can
+// be isolated by splitting the batch. Failures to connect, authenticate or reach the database are not.
+func isEntityError(err error) bool {
+	var entityError *EntityError
+	if errors.As(err, &entityError) {
+		return true
+	}
+	var neo4jError *neo4j.Neo4jError
+	if errors.As(err, &neo4jError) {
+		return isStatementError(err) || neo4jError.Code == "Neo.ClientError.Schema.ConstraintValidationFailed"
+	}
+	return false
+}
+
+// isStatementError reports whether the graph refused a statement itself, such as for its syntax or types
+func isStatementError(err error) bool {
+	var neo4jError *neo4j.Neo4jError
+	return errors.As(err, &neo4jError) && strings.HasPrefix(neo4jError.Code, "Neo.ClientError.Statement.")
+}
+
+// errorCategory classifies a write error for metrics
+func errorCategory(err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "cancelled"
+	}
+	var connectivityError *neo4j.ConnectivityError
+	if errors.As(err, &connectivityError) {
+		return "connectivity"
+	}
+	var neo4jError *neo4j.Neo4jError
+	if errors.As(err, &neo4jError) {
+		switch neo4jError.Classification() {
+		case "ClientError":
+			return "client"
+		case "TransientError":
+			return "transient"
+		case "DatabaseError":
+			return "database"
+		}
+	}
+	return "other"
+}
+
+// ExecuteWrite runs work in a transaction and commits it, retrying the whole transaction when it fails
+// with an error the server or driver classifies as transient such as deadlocks, leader switches and
+// lost connections. Other errors are returned straight away.
+func (n *Neo4jClient) ExecuteWrite(ctx context.Context, source string, timeout time.Duration, work func(txn CypherTransaction) error) error {
+	err := n.executeWithRetries(ctx, source, timeout, work)
+	if err != nil {
+		n.metrics.Incr("opencypher.write.errors", append(n.tags(source), "category:"+errorCategory(err)), 1)
+	}
+	return err
+}
+
+func (n *Neo4jClient) executeWithRetries(ctx context.Context, source string, timeout time.Duration, work func(txn CypherTransaction) error) error {
+	start := time.Now()
+	retries := 0
+	for {
+		err := n.executeOnce(ctx, timeout, work)
+		if err == nil {
+			return nil
+		}
+
+		// a cancelled or expired context fails any attempt, so there is no point in retrying
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if !isTransient(err) {
+			return err
+		}
+
+		if retries >= n.retryPolicy.MaxRetries {
+			return fmt.Errorf("giving up after %d retries: %w", retries, err)
+		}
+
+		delay := n.retryPolicy.delay(retries + 1)
+		if time.Since(start)+delay > n.retryPolicy.MaxTime {
+			return fmt.Errorf("giving up after %d retries as retry time of %s is exceeded: %w", retries, n.retryPolicy.MaxTime, err)
+		}
+
+		retries++
+		n.logger.Warn("retrying transaction after transient error", "source", source, "retry", retries, "delay", delay.String(), "error", err.Error())
+		n.metrics.Incr("opencypher.write.retries", n.tags(source), 1)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (n *Neo4jClient) executeOnce(ctx context.Context, timeout time.Duration, work func(txn CypherTransaction) error) error {
+	transport, err := n.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer transport.Close(ctx)
+
+	txn, err := transport.BeginTransaction(ctx, timeout)
+	if err != nil {
+		return err
+	}
+	defer txn.Close(ctx)
+
+	err = work(txn)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit(ctx)
+}
@@ -0,0 +1,253 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	IndexTypeRange    = "range"
+	IndexTypeText     = "text"
+	IndexTypeFulltext = "fulltext"
+	IndexTypeUnique   = "unique" // uniqueness constraint
+	IndexTypeExists   = "exists" // property existence constraint, needs neo4j enterprise
+	IndexTypeVector   = "vector" // similarity search over an embedding property
+)
+
+// IndexConfig declares an index or constraint on the nodes of a dataset or on a type of relationship
+type IndexConfig struct {
+	Name         string   `json:"name"`         // defaults to the label or relationship type, the index type and the properties joined by _
+	Type         string   `json:"type"`         // range (default), text, fulltext, unique, exists or vector
+	Properties   []string `json:"properties"`   // several make a composite range index or unique constraint, or a full-text index over each
+	Relationship string   `json:"relationship"` // relationship type indexed instead of the dataset label
+	Dimensions   int      `json:"dimensions"`   // length of the embeddings of a vector index
+	Similarity   string   `json:"similarity"`   // similarity function of a vector index, cosine (default) or euclidean
+}
+
+// LabelSchema holds the indexes and constraints kept in a database for the nodes of one label. The index
+// on gid used to match entities is always part of it.
+type LabelSchema struct {
+	Label         string
+	Indexes       []IndexConfig
+	DropUnmanaged bool // drop other indexes and constraints on the label and on the relationship types in Indexes
+}
+
+const ShowIndexesQuery = "SHOW INDEXES YIELD name, type, entityType, labelsOrTypes, properties, options, owningConstraint RETURN name, type, entityType, labelsOrTypes, properties, options, owningConstraint"
+
+const ShowConstraintsQuery = "SHOW CONSTRAINTS YIELD name, type, entityType, labelsOrTypes, properties RETURN name, type, entityType, labelsOrTypes, properties"
+
+func gidIndexName(label string) string {
+	return "external_id_index_" + label
+}
+
+func (i IndexConfig) indexType() string {
+	if i.Type == "" {
+		return IndexTypeRange
+	}
+	return i.Type
+}
+
+// indexName returns the configured name or the one derived from the label, type and properties
+func (i IndexConfig) indexName(label string) string {
+	if i.Name != "" {
+		return i.Name
+	}
+	if i.Relationship != "" {
+		label = i.Relationship
+	}
+	return strings.Join(append([]string{label, i.indexType()}, i.Properties...), "_")
+}
+
+// createStatement returns the cypher creating the index or constraint unless it exists
+func (i IndexConfig) createStatement(label string) string {
+	pattern := fmt.Sprintf("(n:%s)", label)
+	if i.Relationship != "" {
+		pattern = fmt.Sprintf("()-[n:%s]-()", i.Relationship)
+	}
+	properties := make([]string, 0, len(i.Properties))
+	for _, property := range i.Properties {
+		properties = append(properties, "n."+property)
+	}
+	list := strings.Join(properties, ", ")
+	name := i.indexName(label)
+
+	switch i.indexType() {
+	case IndexTypeText:
+		return fmt.Sprintf("CREATE TEXT INDEX %s IF NOT EXISTS FOR %s ON (%s)", name, pattern, list)
+	case IndexTypeFulltext:
+		return fmt.Sprintf("CREATE FULLTEXT INDEX %s IF NOT EXISTS FOR %s ON EACH [%s]", name, pattern, list)
+	case IndexTypeUnique:
+		return fmt.Sprintf("CREATE CONSTRAINT %s IF NOT EXISTS FOR %s REQUIRE (%s) IS UNIQUE", name, pattern, list)
+	case IndexTypeExists:
+		return fmt.Sprintf("CREATE CONSTRAINT %s IF NOT EXISTS FOR %s REQUIRE %s IS NOT NULL", name, pattern, list)
+	case IndexTypeVector:
+		return fmt.Sprintf("CREATE VECTOR INDEX %s IF NOT EXISTS FOR %s ON (%s) OPTIONS {indexConfig: {`vector.dimensions`: %d, `vector.similarity_function`: '%s'}}",
+			name, pattern, list, i.Dimensions, i.similarity())
+	default:
+		return fmt.Sprintf("CREATE INDEX %s IF NOT EXISTS FOR %s ON (%s)", name, pattern, list)
+	}
+}
+
+func (i IndexConfig) similarity() string {
+	if i.Similarity == "" {
+		return VectorSimilarityCosine
+	}
+	return i.Similarity
+}
+
+// matches tells whether an index or constraint listed by the server has the declared definition, rows
+// of SHOW CONSTRAINTS are constraints and the others indexes
+func (i IndexConfig) matches(label string, row map[string]any, constraint bool) bool {
+	entityType, target := "NODE", label
+	if i.Relationship != "" {
+		entityType, target = "RELATIONSHIP", i.Relationship
+	}
+	if row["entityType"] != entityType || !slices.Equal(stringList(row["labelsOrTypes"]), []string{target}) || !slices.Equal(stringList(row["properties"]), i.Properties) {
+		return false
+	}
+	kind, _ := row["type"].(string)
+	switch i.indexType() {
+	case IndexTypeUnique:
+		return constraint && strings.HasSuffix(kind, "UNIQUENESS")
+	case IndexTypeExists:
+		return constraint && strings.HasSuffix(kind, "EXISTENCE")
+	case IndexTypeVector:
+		options, _ := row["options"].(map[string]any)
+		config, _ := options["indexConfig"].(map[string]any)
+		similarity, _ := config["vector.similarity_function"].(string)
+		return !constraint && kind == "VECTOR" && asInt(config["vector.dimensions"]) == i.Dimensions && strings.EqualFold(similarity, i.similarity())
+	default:
+		return !constraint && strings.EqualFold(kind, i.indexType())
+	}
+}
+
+// memgraphCreateStatement returns the memgraph statement creating a range index, the only kind supported there
+func (i IndexConfig) memgraphCreateStatement(label string) string {
+	return fmt.Sprintf("CREATE INDEX ON :%s(%s)", label, strings.Join(i.Properties, ", "))
+}
+
+// checkIndexes adds a problem for each index declaration that cannot be created
+func checkIndexes(indexes []IndexConfig, problems *configProblems) {
+	names := make(map[string]bool)
+	for n, index := range indexes {
+		key := fmt.Sprintf("indexes[%d]", n)
+		switch index.indexType() {
+		case IndexTypeRange, IndexTypeText, IndexTypeFulltext, IndexTypeUnique, IndexTypeExists:
+		case IndexTypeVector:
+			if index.Dimensions < 1 || index.Dimensions > MaxVectorDimensions {
+				problems.add("%s.dimensions must be between 1 and %d", key, MaxVectorDimensions)
+			}
+			if index.similarity() != VectorSimilarityCosine && index.similarity() != VectorSimilarityEuclidean {
+				problems.add("unsupported %s.similarity %s, must be %s or %s", key, index.Similarity, VectorSimilarityCosine, VectorSimilarityEuclidean)
+			}
+			if index.Relationship != "" {
+				problems.add("%s of type vector must be on the dataset label", key)
+			}
+		default:
+			problems.add("unsupported %s.type %s", key, index.Type)
+		}
+		if len(index.Properties) == 0 {
+			problems.add("no %s.properties specified", key)
+		}
+		if len(index.Properties) > 1 && (index.indexType() == IndexTypeText || index.indexType() == IndexTypeExists || index.indexType() == IndexTypeVector) {
+			problems.add("%s of type %s takes a single property", key, index.indexType())
+		}
+		for _, property := range index.Properties {
+			checkIdentifier(key+".properties", property, problems)
+		}
+		if index.Relationship != "" {
+			checkIdentifier(key+".relationship", index.Relationship, problems)
+		}
+		if index.Name != "" {
+			checkIdentifier(key+".name", index.Name, problems)
+			if names[index.Name] {
+				problems.add("%s.name %s is used more than once", key, index.Name)
+			}
+			names[index.Name] = true
+		}
+	}
+}
+
+// checkMemgraphIndexes adds a problem for each index declaration memgraph does not support
+func checkMemgraphIndexes(indexes []IndexConfig, dropUnmanaged bool, problems *configProblems) {
+	for n, index := range indexes {
+		if index.indexType() != IndexTypeRange || index.Relationship != "" {
+			problems.add("indexes[%d]: memgraph only supports range indexes on the dataset label", n)
+		}
+	}
+	if dropUnmanaged {
+		problems.add("drop_unmanaged_indexes is not supported by memgraph")
+	}
+}
+
+// schemaDrops returns the statements dropping indexes and constraints on the labels and relationship
+// types of schemas that drop unmanaged ones, other than the ones declared. Declared ones that exist
+// with another definition are dropped too, as creating them again would leave the existing one as is.
+func (n *Neo4jClient) schemaDrops(ctx context.Context, transport CypherTransport, schemas []LabelSchema) ([]string, error) {
+	managed := make(map[string]bool)
+	declared := make(map[string]func(row map[string]any, constraint bool) bool) // definition checks by name
+	nodes := make(map[string]bool)
+	relationships := make(map[string]bool)
+	for _, schema := range schemas {
+		managed[gidIndexName(schema.Label)] = true
+		for _, index := range schema.Indexes {
+			managed[index.indexName(schema.Label)] = true
+			label, index := schema.Label, index
+			declared[index.indexName(schema.Label)] = func(row map[string]any, constraint bool) bool {
+				return index.matches(label, row, constraint)
+			}
+			if schema.DropUnmanaged && index.Relationship != "" {
+				relationships[index.Relationship] = true
+			}
+		}
+		if schema.DropUnmanaged {
+			nodes[schema.Label] = true
+		}
+	}
+
+	owned := func(name string, row map[string]any) bool {
+		labelsOrTypes := stringList(row["labelsOrTypes"])
+		if name == "" || managed[name] || len(labelsOrTypes) != 1 {
+			return false
+		}
+		if row["entityType"] == "RELATIONSHIP" {
+			return relationships[labelsOrTypes[0]]
+		}
+		return nodes[labelsOrTypes[0]]
+	}
+
+	drops := make([]string, 0)
+	constraints, err := transport.Collect(ctx, ShowConstraintsQuery, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not list constraints because %s", err.Error())
+	}
+	for _, row := range constraints {
+		name, _ := row["name"].(string)
+		if matches, ok := declared[name]; ok && !matches(row, true) || owned(name, row) {
+			drops = append(drops, "DROP CONSTRAINT "+quoteName(name)+" IF EXISTS")
+		}
+	}
+
+	indexes, err := transport.Collect(ctx, ShowIndexesQuery, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not list indexes because %s", err.Error())
+	}
+	for _, row := range indexes {
+		name, _ := row["name"].(string)
+		// indexes backing a constraint go with the constraint
+		if row["type"] == "LOOKUP" || row["owningConstraint"] != nil {
+			continue
+		}
+		if matches, ok := declared[name]; ok && !matches(row, false) || owned(name, row) {
+			drops = append(drops, "DROP INDEX "+quoteName(name)+" IF EXISTS")
+		}
+	}
+	return drops, nil
+}
+
+// quoteName quotes an index or constraint name read from the server
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
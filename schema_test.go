@@ -0,0 +1,87 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReconcileIndexes(t *testing.T) {
+	api := &fakeQueryAPI{results: map[string]string{
+		"SHOW CONSTRAINTS": `{"fields":["name","type","entityType","labelsOrTypes","properties"],"values":[` +
+			`["Person_unique_email","NODE_PROPERTY_UNIQUENESS","NODE",["Person"],["email"]],` +
+			`["old_constraint","NODE_PROPERTY_UNIQUENESS","NODE",["Person"],["code"]],` +
+			`["Company_unique_orgnr","NODE_PROPERTY_UNIQUENESS","NODE",["Company"],["orgnr"]]]}`,
+		"SHOW INDEXES": `{"fields":["name","type","entityType","labelsOrTypes","properties","options","owningConstraint"],"values":[` +
+			`["external_id_index_Person","RANGE","NODE",["Person"],["gid"],{},null],` +
+			`["Person_range_name_born","RANGE","NODE",["Person"],["name","born"],{},null],` +
+			`["Person_text_name","RANGE","NODE",["Person"],["name"],{},null],` +
+			`["person_search","FULLTEXT","NODE",["Person"],["name"],{},null],` +
+			`["Person_vector_embedding","VECTOR","NODE",["Person"],["embedding"],{"indexConfig":{"vector.dimensions":2,"vector.similarity_function":"COSINE"}},null],` +
+			`["Person_unique_email","RANGE","NODE",["Person"],["email"],{},"Person_unique_email"],` +
+			`["old_index","RANGE","NODE",["Person"],["name"],{},null],` +
+			`["old_constraint","RANGE","NODE",["Person"],["code"],{},"old_constraint"],` +
+			`["old_rel_index","RANGE","RELATIONSHIP",["worksFor"],["since"],{},null],` +
+			`["other_rel_index","RANGE","RELATIONSHIP",["knows"],["since"],{},null],` +
+			`["index_343aff4e","LOOKUP","NODE",null,null,{},null]]}`,
+	}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	schemas := []LabelSchema{
+		{Label: "Person", DropUnmanaged: true, Indexes: []IndexConfig{
+			{Properties: []string{"name", "born"}},
+			{Type: IndexTypeText, Properties: []string{"name"}},
+			{Type: IndexTypeFulltext, Name: "person_search", Properties: []string{"name", "bio"}},
+			{Type: IndexTypeUnique, Properties: []string{"email"}},
+			{Type: IndexTypeExists, Relationship: "worksFor", Properties: []string{"since"}},
+			{Type: IndexTypeVector, Properties: []string{"embedding"}, Dimensions: 3},
+		}},
+		{Label: "Company"},
+	}
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	err := client.Initialise(context.Background(), schemas)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		ShowConstraintsQuery,
+		ShowIndexesQuery,
+		"DROP CONSTRAINT `old_constraint` IF EXISTS",
+		"DROP INDEX `Person_text_name` IF EXISTS",
+		"DROP INDEX `person_search` IF EXISTS",
+		"DROP INDEX `Person_vector_embedding` IF EXISTS",
+		"DROP INDEX `old_index` IF EXISTS",
+		"DROP INDEX `old_rel_index` IF EXISTS",
+		"CREATE INDEX external_id_index_Person IF NOT EXISTS FOR (n:Person) ON (n.gid)",
+		"CREATE INDEX Person_range_name_born IF NOT EXISTS FOR (n:Person) ON (n.name, n.born)",
+		"CREATE TEXT INDEX Person_text_name IF NOT EXISTS FOR (n:Person) ON (n.name)",
+		"CREATE FULLTEXT INDEX person_search IF NOT EXISTS FOR (n:Person) ON EACH [n.name, n.bio]",
+		"CREATE CONSTRAINT Person_unique_email IF NOT EXISTS FOR (n:Person) REQUIRE (n.email) IS UNIQUE",
+		"CREATE CONSTRAINT worksFor_exists_since IF NOT EXISTS FOR ()-[n:worksFor]-() REQUIRE n.since IS NOT NULL",
+		"CREATE VECTOR INDEX Person_vector_embedding IF NOT EXISTS FOR (n:Person) ON (n.embedding) OPTIONS {indexConfig: {`vector.dimensions`: 3, `vector.similarity_function`: 'cosine'}}",
+		"CREATE INDEX external_id_index_Company IF NOT EXISTS FOR (n:Company) ON (n.gid)",
+	}
+	if !slices.Equal(api.statements, expected) {
+		t.Errorf("Unexpected statements\n%s", strings.Join(api.statements, "\n"))
+	}
+	if api.requests[len(api.requests)-1] != "POST /db/neo4j/query/v2/tx/tx1/commit" {
+		t.Errorf("Expected the index changes to be committed, got %v", api.requests)
+	}
+
+	api.failOn = "FULLTEXT"
+	err = client.Initialise(context.Background(), schemas)
+	if err == nil || !strings.HasPrefix(err.Error(), "could not create fulltext index person_search because") {
+		t.Errorf("Expected failing index to be reported, got %v", err)
+	}
+
+	problems := configProblems{}
+	checkIndexes([]IndexConfig{{Type: "point", Properties: []string{"location"}}, {Type: IndexTypeText, Properties: []string{"a", "b-c"}}}, &problems)
+	if problems.Error() != "unsupported indexes[0].type point; indexes[1] of type text takes a single property; indexes[1].properties 'b-c' must start with a letter or underscore and contain only letters, digits and underscores" {
+		t.Errorf("Unexpected problems %s", problems.Error())
+	}
+}
@@ -0,0 +1,69 @@
+package layer
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// secretReference matches ${NAME} in credentials, any other $ is kept as it is
+var secretReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Credentials authenticate against a graph system with one of the auth schemes. Each secret is either
+// given in the config, with ${NAME} replaced by the environment variable NAME, or read from a file such
+// as a mounted secret. They are resolved whenever a connection is opened or the server rejects them, so
+// rotated secrets are used without a restart.
+type Credentials struct {
+	Scheme       string // basic, bearer, kerberos or none, empty for basic
+	Username     string
+	Password     string
+	UsernameFile string // file holding the username, used instead of Username
+	PasswordFile string // file holding the password, used instead of Password
+	Realm        string // realm of basic auth
+	Token        string // bearer token or base64 kerberos ticket
+	TokenFile    string // file holding the token, used instead of Token
+}
+
+// Resolve returns the current username and password of basic auth
+func (c Credentials) Resolve() (string, string, error) {
+	username, err := resolveSecret("username", c.Username, c.UsernameFile)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := resolveSecret("password", c.Password, c.PasswordFile)
+	if err != nil {
+		return "", "", err
+	}
+	return username, password, nil
+}
+
+// resolveToken returns the current bearer token or kerberos ticket
+func (c Credentials) resolveToken() (string, error) {
+	return resolveSecret("token", c.Token, c.TokenFile)
+}
+
+func resolveSecret(name string, value string, file string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s file because %s", name, err.Error())
+		}
+		// secret files are often written with a trailing newline
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	missing := make([]string, 0)
+	expanded := secretReference.ReplaceAllStringFunc(value, func(reference string) string {
+		variable := secretReference.FindStringSubmatch(reference)[1]
+		resolved, ok := os.LookupEnv(variable)
+		if !ok {
+			missing = append(missing, variable)
+		}
+		return resolved
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %s used in %s is not set", strings.Join(missing, ", "), name)
+	}
+	return expanded, nil
+}
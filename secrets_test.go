@@ -0,0 +1,50 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredentialsFromEnvironmentAndFiles(t *testing.T) {
+	t.Setenv("TEST_NEO4J_USER", "neo4j")
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(passwordFile, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := Credentials{Username: "${TEST_NEO4J_USER}", PasswordFile: passwordFile}
+	username, password, err := credentials.Resolve()
+	if err != nil || username != "neo4j" || password != "secret" {
+		t.Errorf("Unexpected credentials %s %s %v", username, password, err)
+	}
+
+	_, password, _ = Credentials{Password: "pa$word${TEST_NEO4J_USER}"}.Resolve()
+	if password != "pa$wordneo4j" {
+		t.Errorf("Expected only ${} references to be expanded, got %s", password)
+	}
+
+	_, _, err = Credentials{Password: "${TEST_NEO4J_MISSING}"}.Resolve()
+	if err == nil || err.Error() != "environment variable TEST_NEO4J_MISSING used in password is not set" {
+		t.Errorf("Expected missing variable, got %v", err)
+	}
+
+	// a rotated password is used by the next connection without recreating the client
+	server := httptest.NewServer(&fakeQueryAPI{})
+	defer server.Close()
+	client := NewNeo4jClient(server.URL, "", credentials, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if status := client.CheckHealth(context.Background(), nil); !status.Healthy {
+		t.Errorf("Expected healthy graph, got %+v", status)
+	}
+	err = os.WriteFile(passwordFile, []byte("rotated\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := client.CheckHealth(context.Background(), nil); status.Healthy {
+		t.Errorf("Expected the rotated password to be rejected by the fake server, got %+v", status)
+	}
+}
@@ -0,0 +1,250 @@
+package layer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bound for the wait between drain attempts while the graph is failing
+const maxSpoolRetryInterval = 5 * time.Minute
+
+// Spool is a write-ahead queue of incremental batches on local disk. Batches are acknowledged once
+// they are persisted and a background worker drains them to the graph in order, retrying with backoff
+// while the graph is unavailable.
+type Spool struct {
+	dir           string
+	datasetName   string
+	retryInterval time.Duration
+	write         func(ctx context.Context, entities []*egdm.Entity) error
+	logger        cdl.Logger
+	metrics       cdl.Metrics
+	tags          []string
+	lock          sync.Mutex // held while draining so batches are written one at a time and in order
+	sequence      atomic.Uint64
+	notify        chan struct{}
+	ctx           context.Context // cancelled on stop to abort a drain in progress
+	cancel        context.CancelFunc
+	stopped       sync.WaitGroup
+}
+
+func NewSpool(dir string, datasetName string, retryInterval time.Duration, write func(ctx context.Context, entities []*egdm.Entity) error, logger cdl.Logger, metrics cdl.Metrics, tags []string) (*Spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	spool := &Spool{
+		dir:           dir,
+		datasetName:   datasetName,
+		retryInterval: retryInterval,
+		write:         write,
+		logger:        logger,
+		metrics:       metrics,
+		tags:          tags,
+		notify:        make(chan struct{}, 1),
+	}
+	spool.ctx, spool.cancel = context.WithCancel(context.Background())
+	return spool, nil
+}
+
+// Start starts the background worker draining the spool
+func (s *Spool) Start() {
+	// remove batches that were not fully written before a crash, they were never acknowledged
+	tmpFiles, _ := filepath.Glob(filepath.Join(s.dir, "*.tmp"))
+	for _, tmpFile := range tmpFiles {
+		os.Remove(tmpFile)
+	}
+
+	s.stopped.Add(1)
+	go s.run()
+
+	// drain anything left over from before a restart
+	s.signal()
+}
+
+// Append persists a batch and wakes up the worker. The batch is written to a temporary file that is
+// synced and renamed, so a crash never leaves a partial batch in the spool.
+func (s *Spool) Append(entities []*egdm.Entity) error {
+	name := fmt.Sprintf("batch-%020d-%06d.ndjson", time.Now().UnixNano(), s.sequence.Add(1)%1000000)
+	tmpName := filepath.Join(s.dir, name+".tmp")
+
+	file, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, entity := range entities {
+		err = encoder.Encode(entity)
+		if err != nil {
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpName, filepath.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+
+	s.signal()
+	return nil
+}
+
+func (s *Spool) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Spool) run() {
+	defer s.stopped.Done()
+	interval := s.retryInterval
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.notify:
+		case <-time.After(interval):
+		}
+
+		err := s.Drain(s.ctx)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			s.logger.Warn(fmt.Sprintf("could not drain spool for dataset %s, retrying in %s", s.datasetName, interval), "error", err.Error())
+			interval *= 2
+			if interval > maxSpoolRetryInterval {
+				interval = maxSpoolRetryInterval
+			}
+		} else {
+			interval = s.retryInterval
+		}
+	}
+}
+
+// Drain writes all spooled batches to the graph in the order they were received and removes them.
+// It stops at the first batch that cannot be written or when ctx is done.
+func (s *Spool) Drain(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	batches, err := s.batches()
+	if err != nil {
+		return err
+	}
+	defer s.report()
+
+	for _, batch := range batches {
+		entities, err := readSpooledBatch(batch)
+		if err != nil {
+			return err
+		}
+
+		s.logger.Debug(fmt.Sprintf("draining spooled batch of %d entities to dataset %s", len(entities), s.datasetName))
+		err = s.write(ctx, entities)
+		if err != nil {
+			return err
+		}
+
+		err = os.Remove(batch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop ends the background worker, batches left in the spool are drained after the next start
+func (s *Spool) Stop() {
+	s.cancel()
+	s.stopped.Wait()
+}
+
+// batches lists the spooled batch files oldest first
+func (s *Spool) batches() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	batches := make([]string, 0)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "batch-") && strings.HasSuffix(entry.Name(), ".ndjson") {
+			batches = append(batches, filepath.Join(s.dir, entry.Name()))
+		}
+	}
+	sort.Strings(batches)
+	return batches, nil
+}
+
+// report emits the spool depth and the age of the oldest spooled batch
+func (s *Spool) report() {
+	batches, err := s.batches()
+	if err != nil {
+		return
+	}
+
+	lag := time.Duration(0)
+	if len(batches) > 0 {
+		name := filepath.Base(batches[0])
+		nanos, err := strconv.ParseInt(strings.Split(name, "-")[1], 10, 64)
+		if err == nil {
+			lag = time.Since(time.Unix(0, nanos))
+		}
+	}
+
+	s.metrics.Gauge("opencypher.spool.depth", float64(len(batches)), s.tags, 1)
+	s.metrics.Gauge("opencypher.spool.lag", lag.Seconds(), s.tags, 1)
+}
+
+func readSpooledBatch(path string) ([]*egdm.Entity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entities := make([]*egdm.Entity, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		entity := egdm.NewEntity()
+		err = json.Unmarshal(scanner.Bytes(), entity)
+		if err != nil {
+			return nil, fmt.Errorf("could not read spooled entity in %s because %s", path, err.Error())
+		}
+		entities = append(entities, entity)
+	}
+	return entities, scanner.Err()
+}
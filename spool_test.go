@@ -0,0 +1,81 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"os"
+	"testing"
+)
+
+func TestSpoolDrainsAfterOutage(t *testing.T) {
+	dir := t.TempDir()
+	client := &fakeQueryClient{unavailable: true}
+	metrics := newTestMetrics()
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{
+		"label":                "Person",
+		"batch_size":           2,
+		"spool_dir":            dir,
+		"spool_retry_interval": "1h",
+	}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Stop()
+
+	// writes are acknowledged while the graph is down
+	writer, layerErr := ds.Incremental(context.Background())
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		layerErr = writer.Write(makeEntity(id))
+		if layerErr != nil {
+			t.Fatal(layerErr)
+		}
+	}
+	layerErr = writer.Close()
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+
+	if ds.spool.Drain(context.Background()) == nil {
+		t.Error("Expected drain to fail while the graph is unavailable")
+	}
+	batches, _ := ds.spool.batches()
+	if len(batches) != 2 {
+		t.Errorf("Expected 2 spooled batches, got %d", len(batches))
+	}
+	if metrics.gauge("opencypher.spool.depth") != 2 {
+		t.Errorf("Expected spool depth 2, got %f", metrics.gauge("opencypher.spool.depth"))
+	}
+
+	// once the graph is back the batches are written in order
+	client.lock.Lock()
+	client.unavailable = false
+	client.lock.Unlock()
+	err = ds.spool.Drain(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.written) != 3 || client.written[0].ID != "http://data.sample.org/things/1" || client.written[2].ID != "http://data.sample.org/things/3" {
+		t.Errorf("Expected 3 entities written in order, got %d", len(client.written))
+	}
+	if client.written[0].References["http://data.sample.org/worksfor"] == nil {
+		t.Error("Expected references to survive the spool")
+	}
+	if metrics.gauge("opencypher.entities.received") != 3 {
+		t.Errorf("Expected spooled entities to be counted once, got %f", metrics.gauge("opencypher.entities.received"))
+	}
+	batches, _ = ds.spool.batches()
+	if len(batches) != 0 || metrics.gauge("opencypher.spool.depth") != 0 {
+		t.Errorf("Expected empty spool, got %d batches", len(batches))
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			t.Errorf("Unexpected file left in spool %s", entry.Name())
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package layer
+
+import (
+	cdl "github.com/mimiro-io/common-datalayer"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WriteStats counts the changes made by write statements. The json names match the counters of the
+// neo4j http query api so they can be decoded straight from its responses.
+type WriteStats struct {
+	NodesCreated         int `json:"nodesCreated"`
+	NodesDeleted         int `json:"nodesDeleted"`
+	RelationshipsCreated int `json:"relationshipsCreated"`
+	RelationshipsDeleted int `json:"relationshipsDeleted"`
+	PropertiesSet        int `json:"propertiesSet"`
+	LabelsAdded          int `json:"labelsAdded"`
+}
+
+func (s *WriteStats) Add(other WriteStats) {
+	s.NodesCreated += other.NodesCreated
+	s.NodesDeleted += other.NodesDeleted
+	s.RelationshipsCreated += other.RelationshipsCreated
+	s.RelationshipsDeleted += other.RelationshipsDeleted
+	s.PropertiesSet += other.PropertiesSet
+	s.LabelsAdded += other.LabelsAdded
+}
+
+// logArgs returns the counters as key value pairs for the logger
+func (s WriteStats) logArgs() []any {
+	return []any{
+		"nodesCreated", s.NodesCreated,
+		"nodesDeleted", s.NodesDeleted,
+		"relationshipsCreated", s.RelationshipsCreated,
+		"relationshipsDeleted", s.RelationshipsDeleted,
+		"propertiesSet", s.PropertiesSet,
+		"labelsAdded", s.LabelsAdded,
+	}
+}
+
+// emit adds the counters to the write metrics
+func (s WriteStats) emit(metrics cdl.Metrics, tags []string) {
+	addTotal(metrics, "opencypher.write.nodes_created", tags, s.NodesCreated)
+	addTotal(metrics, "opencypher.write.nodes_deleted", tags, s.NodesDeleted)
+	addTotal(metrics, "opencypher.write.relationships_created", tags, s.RelationshipsCreated)
+	addTotal(metrics, "opencypher.write.relationships_deleted", tags, s.RelationshipsDeleted)
+	addTotal(metrics, "opencypher.write.properties_set", tags, s.PropertiesSet)
+	addTotal(metrics, "opencypher.write.labels_added", tags, s.LabelsAdded)
+}
+
+// totalKey identifies a running total by the metrics it is reported to, its name and its tags
+type totalKey struct {
+	metrics cdl.Metrics
+	name    string
+	tags    string
+}
+
+var (
+	totalsLock sync.Mutex
+	totals     = make(map[totalKey]float64)
+)
+
+// addTotal adds n to a running total and reports it as a gauge. The last argument of Metrics.Incr is
+// the statsd sample rate rather than an amount, so counts that grow by more than one per call are
+// reported as totals since the start of the layer.
+func addTotal(metrics cdl.Metrics, name string, tags []string, n int) {
+	if n == 0 {
+		return
+	}
+	key := totalKey{metrics: metrics, name: name, tags: strings.Join(tags, ",")}
+	totalsLock.Lock()
+	totals[key] += float64(n)
+	total := totals[key]
+	totalsLock.Unlock()
+	metrics.Gauge(name, total, tags, 1)
+}
+
+const (
+	SyncTypeFull        = "full"
+	SyncTypeIncremental = "incremental"
+)
+
+// SyncStats are the totals of one sync, a full sync spans all its batches
+type SyncStats struct {
+	SyncId   string    `json:"syncId,omitempty"`
+	Type     string    `json:"type"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Batches  int       `json:"batches"`
+	Entities int       `json:"entities"`
+	Error    string    `json:"error,omitempty"` // why the sync or its hooks failed
+	WriteStats
+}
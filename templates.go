@@ -0,0 +1,70 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// WriteTemplates replaces the statements writing the entities of a dataset. Each statement gets the
+// same $items list as the statement it replaces, empty ones keep the default statement.
+type WriteTemplates struct {
+	UpdateNode         string `json:"update_node"`         // items hold gid, source and the properties of each entity
+	UpdateRelationship string `json:"update_relationship"` // items hold from, to, rel and source of each reference
+	DeleteNode         string `json:"delete_node"`         // items hold the gid of each deleted entity
+}
+
+func (t *WriteTemplates) updateNode(label string) string {
+	if t == nil || t.UpdateNode == "" {
+		return fmt.Sprintf(UpdateNodeQueryTemplate, label)
+	}
+	return t.UpdateNode
+}
+
+func (t *WriteTemplates) updateRelationship(relType string) string {
+	if t == nil || t.UpdateRelationship == "" {
+		return fmt.Sprintf(UpdateEdgeQueryTemplate, relType)
+	}
+	return t.UpdateRelationship
+}
+
+func (t *WriteTemplates) deleteNode() string {
+	if t == nil || t.DeleteNode == "" {
+		return DeleteNodeQueryTemplate
+	}
+	return t.DeleteNode
+}
+
+// custom returns the configured templates by config key
+func (t *WriteTemplates) custom() map[string]string {
+	templates := make(map[string]string)
+	if t == nil {
+		return templates
+	}
+	for key, statement := range map[string]string{"update_node": t.UpdateNode, "update_relationship": t.UpdateRelationship, "delete_node": t.DeleteNode} {
+		if statement != "" {
+			templates[key] = statement
+		}
+	}
+	return templates
+}
+
+// checkTemplates adds a problem for each template that cannot receive the items
+func checkTemplates(t *WriteTemplates, problems *configProblems) {
+	for _, key := range []string{"delete_node", "update_node", "update_relationship"} {
+		statement, ok := t.custom()[key]
+		if ok && !strings.Contains(statement, "$items") {
+			problems.add("write_templates.%s must use $items", key)
+		}
+	}
+}
+
+// Explain asks the graph to plan the statement without running it, reporting syntax and semantic errors
+func (n *Neo4jClient) Explain(ctx context.Context, statement string) error {
+	transport, err := n.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer transport.Close(ctx)
+	return transport.Run(ctx, "EXPLAIN "+statement, map[string]any{"items": []any{}})
+}
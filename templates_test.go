@@ -0,0 +1,48 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestWriteTemplates(t *testing.T) {
+	api := &fakeQueryAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+
+	templates := &WriteTemplates{
+		UpdateNode: "UNWIND $items AS item MERGE (n:Person {gid: item.gid}) SET n += item",
+		DeleteNode: "UNWIND $items AS item MATCH (n:Person {gid: item.gid}) SET n.deleted = true",
+	}
+	entity := makeEntity("1")
+	deleted := makeEntity("3")
+	deleted.IsDeleted = true
+	_, err := client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{entity, deleted}, WriteOptions{Templates: templates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(api.statements, templates.UpdateNode) || !slices.Contains(api.statements, templates.DeleteNode) {
+		t.Errorf("Expected the custom templates to be used, got %v", api.statements)
+	}
+	if !slices.ContainsFunc(api.statements, func(statement string) bool { return strings.Contains(statement, "MERGE (n1)-[r:worksfor]->(n2)") }) {
+		t.Errorf("Expected the default relationship statement, got %v", api.statements)
+	}
+
+	api.statements = nil
+	api.failOn = "EXPLAIN"
+	err = client.Explain(context.Background(), templates.UpdateNode)
+	if err == nil || len(api.statements) != 1 || api.statements[0] != "EXPLAIN "+templates.UpdateNode {
+		t.Errorf("Expected the template to be explained and fail, got %v %v", err, api.statements)
+	}
+
+	_, err = NewGraphDatasetConfig(map[string]any{"label": "Person", "write_templates": map[string]any{"update_relationship": "MATCH (n) RETURN n"}})
+	if err == nil || !strings.Contains(err.Error(), "write_templates.update_relationship must use $items") {
+		t.Errorf("Unexpected validation %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package layer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSConfig adds a private certificate authority, a client certificate for mutual tls and a server name
+// override to encrypted connections
+type TLSConfig struct {
+	CAFile     string `json:"ca_file"`     // pem bundle of the authorities trusted for the server certificate, instead of the system ones
+	CertFile   string `json:"cert_file"`   // pem client certificate for mutual tls
+	KeyFile    string `json:"key_file"`    // pem key of the client certificate
+	ServerName string `json:"server_name"` // name expected in the server certificate when it differs from the endpoint host
+}
+
+// isEncryptedEndpoint tells whether the endpoint scheme uses tls, the tls settings apply only to these
+func isEncryptedEndpoint(endpoint string) bool {
+	scheme, _, _ := strings.Cut(endpoint, "://")
+	return scheme == "https" || strings.HasSuffix(scheme, "+s") || strings.HasSuffix(scheme, "+ssc")
+}
+
+// Load reads the certificate files. It is called for each connection so renewed certificates are
+// picked up without a restart.
+func (c *TLSConfig) Load() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: c.ServerName}
+
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca_file because %s", err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ca_file %s holds no pem certificates", c.CAFile)
+		}
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate because %s", err.Error())
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// boltTLS returns the endpoint and tls config for the bolt driver. The driver always verifies the server
+// certificate against the endpoint host, so when another server name is configured the endpoint is
+// switched to the +ssc scheme, which skips that check, and the certificate is verified here instead.
+func (c *TLSConfig) boltTLS(endpoint string) (string, *tls.Config, error) {
+	config, err := c.Load()
+	if err != nil {
+		return "", nil, err
+	}
+	scheme, address, _ := strings.Cut(endpoint, "://")
+	if c.ServerName == "" || !strings.HasSuffix(scheme, "+s") {
+		return endpoint, config, nil
+	}
+
+	roots := config.RootCAs
+	serverName := c.ServerName
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("server sent no certificate")
+		}
+		intermediates := x509.NewCertPool()
+		for _, certificate := range state.PeerCertificates[1:] {
+			intermediates.AddCert(certificate)
+		}
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: serverName, Roots: roots, Intermediates: intermediates})
+		return err
+	}
+	return strings.TrimSuffix(scheme, "+s") + "+ssc://" + address, config, nil
+}
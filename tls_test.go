@@ -0,0 +1,111 @@
+package layer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCertificate issues a certificate signed by parent, or a self signed ca when parent is nil, and
+// writes it and its key as pem files to dir
+func testCertificate(t *testing.T, dir string, name string, parent *tls.Certificate, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	_ = os.WriteFile(filepath.Join(dir, name+".crt"), certPem, 0600)
+	_ = os.WriteFile(filepath.Join(dir, name+".key"), keyPem, 0600)
+
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate.Leaf, _ = x509.ParseCertificate(der)
+	return certificate
+}
+
+func TestMutualTLSWithPrivateCA(t *testing.T) {
+	dir := t.TempDir()
+	ca := testCertificate(t, dir, "ca", nil, x509.ExtKeyUsageAny)
+	serverCertificate := testCertificate(t, dir, "neo4j.internal", &ca, x509.ExtKeyUsageServerAuth)
+	testCertificate(t, dir, "client", &ca, x509.ExtKeyUsageClientAuth)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+
+	server := httptest.NewUnstartedServer(&fakeQueryAPI{})
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCertificate}, ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	tlsConfig := &TLSConfig{
+		CAFile:     filepath.Join(dir, "ca.crt"),
+		CertFile:   filepath.Join(dir, "client.crt"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		ServerName: "neo4j.internal",
+	}
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics()).WithTLS(tlsConfig)
+	if status := client.CheckHealth(context.Background(), nil); !status.Healthy {
+		t.Errorf("Expected healthy graph over mutual tls, got %+v", status)
+	}
+
+	client.WithTLS(&TLSConfig{CAFile: tlsConfig.CAFile, ServerName: "neo4j.internal"})
+	if status := client.CheckHealth(context.Background(), nil); status.Healthy || !strings.Contains(status.Error, "connectivity error") {
+		t.Errorf("Expected the server to require a client certificate, got %+v", status)
+	}
+
+	// the bolt driver gets a +ssc endpoint and the server name is checked by the tls config instead
+	endpoint, boltConfig, err := tlsConfig.boltTLS("neo4j+s://" + strings.TrimPrefix(server.URL, "https://"))
+	if err != nil || !strings.HasPrefix(endpoint, "neo4j+ssc://") {
+		t.Fatalf("Unexpected bolt endpoint %s %v", endpoint, err)
+	}
+	address := strings.TrimPrefix(server.URL, "https://")
+	boltConfig.InsecureSkipVerify = true // as set by the driver for +ssc
+	connection, err := tls.Dial("tcp", address, boltConfig)
+	if err != nil {
+		t.Errorf("Expected the server certificate to verify for neo4j.internal, got %v", err)
+	} else {
+		connection.Close()
+	}
+
+	_, boltConfig, _ = (&TLSConfig{CAFile: tlsConfig.CAFile, CertFile: tlsConfig.CertFile, KeyFile: tlsConfig.KeyFile, ServerName: "other.internal"}).boltTLS("bolt+s://" + address)
+	boltConfig.InsecureSkipVerify = true
+	_, err = tls.Dial("tcp", address, boltConfig)
+	if err == nil {
+		t.Error("Expected the server certificate to be rejected for other.internal")
+	}
+}
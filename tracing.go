@@ -0,0 +1,123 @@
+package layer
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+const (
+	TracingExporterOTLP = "otlp"
+	TracingExporterFile = "file"
+)
+
+const DefaultTracingServiceName = "opencypher-datalayer"
+
+const tracerName = "github.com/mimiro-io/opencypher-datalayer"
+
+// startSpan starts a span with the global tracer provider, a no-op until tracing is configured. The
+// tracer is looked up on each call so a provider installed later is always used.
+func startSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, options...)
+}
+
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"`     // otlp or file
+	Endpoint    string  `json:"endpoint"`     // host:port of the otlp http collector, defaults to the OTEL_EXPORTER_OTLP_ENDPOINT environment
+	Insecure    bool    `json:"insecure"`     // send to the collector over plain http
+	Path        string  `json:"path"`         // file for spans as json lines when exporter is file
+	ServiceName string  `json:"service_name"` // defaults to opencypher-datalayer
+	SampleRatio float64 `json:"sample_ratio"` // fraction of syncs traced, defaults to 1
+}
+
+// NewTracerProvider sets up the exporter from the config and installs the provider globally, so spans
+// of the layer and trace context sent to the neo4j query api use it. The returned provider must be
+// shut down to flush the remaining spans.
+func NewTracerProvider(config *TracingConfig) (*sdktrace.TracerProvider, error) {
+	var exporter sdktrace.SpanExporter
+	switch config.Exporter {
+	case TracingExporterOTLP:
+		options := make([]otlptracehttp.Option, 0)
+		if config.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		otlpExporter, err := otlptracehttp.New(context.Background(), options...)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlpExporter
+	case TracingExporterFile:
+		if config.Path == "" {
+			return nil, fmt.Errorf("no path specified for tracing exporter file")
+		}
+		file, err := os.OpenFile(config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		fileExporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			return nil, err
+		}
+		exporter = fileExporter
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter %s", config.Exporter)
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultTracingServiceName
+	}
+	sampleRatio := config.SampleRatio
+	if sampleRatio == 0 {
+		sampleRatio = 1
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider, nil
+}
+
+// endSpan records err on the span, if any, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startStatementSpan starts the span of a cypher statement
+func (n *Neo4jClient) startStatementSpan(ctx context.Context, kind string, rows int) (context.Context, trace.Span) {
+	return startSpan(ctx, "cypher "+kind, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("db.system", n.systemType),
+		attribute.String("db.namespace", n.database),
+		attribute.String("opencypher.statement.kind", kind),
+		attribute.Int("opencypher.statement.rows", rows),
+	))
+}
+
+// runStatement runs a statement with items in the transaction inside its own span
+func (n *Neo4jClient) runStatement(ctx context.Context, txn CypherTransaction, kind string, query string, items []map[string]any) error {
+	ctx, span := n.startStatementSpan(ctx, kind, len(items))
+	err := txn.Run(ctx, query, map[string]any{"items": items})
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,113 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+
+	api := &fakeQueryAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	client := NewNeo4jClient(server.URL, "graph1", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	definition := &cdl.DatasetDefinition{DatasetName: "people", SourceConfig: map[string]any{"label": "Person", "batch_size": 10}}
+	ds, err := NewGraphDataset("people", client, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer, layerErr := ds.Incremental(context.Background())
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	layerErr = writer.Write(makeEntity("1"))
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+	layerErr = writer.Close()
+	if layerErr != nil {
+		t.Fatal(layerErr)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	incremental, batch, statement := spans["Incremental"], spans["WriteBatch"], spans["cypher update_nodes"]
+	if incremental == nil || batch == nil || statement == nil {
+		t.Fatalf("Expected sync, batch and statement spans, got %v", spans)
+	}
+	if batch.Parent().SpanID() != incremental.SpanContext().SpanID() || statement.Parent().SpanID() != batch.SpanContext().SpanID() {
+		t.Error("Expected statement span inside batch span inside sync span")
+	}
+
+	attributes := make(map[string]string)
+	for _, kv := range statement.Attributes() {
+		attributes[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attributes["db.namespace"] != "graph1" || attributes["opencypher.statement.kind"] != "update_nodes" || attributes["opencypher.statement.rows"] != "1" {
+		t.Errorf("Unexpected statement attributes %v", attributes)
+	}
+
+	// a request failing in Write is never closed, so the failure ends its span
+	definition.SourceConfig["batch_size"] = 1
+	ds, _ = NewGraphDataset("people", &fakeQueryClient{unavailable: true}, definition, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	writer, _ = ds.Incremental(context.Background())
+	for i := 0; i < 10 && layerErr == nil; i++ {
+		layerErr = writer.Write(makeEntity(strconv.Itoa(i)))
+		time.Sleep(time.Millisecond)
+	}
+	if layerErr == nil {
+		t.Fatal("Expected a write to fail")
+	}
+	if !slices.ContainsFunc(recorder.Ended(), func(span sdktrace.ReadOnlySpan) bool {
+		return span.Name() == "Incremental" && span.Status().Code == codes.Error
+	}) {
+		t.Error("Expected the failed sync span to be ended with the error")
+	}
+}
+
+func TestTracingFileExporter(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(previous)
+
+	path := filepath.Join(t.TempDir(), "traces.json")
+	provider, err := NewTracerProvider(&TracingConfig{Exporter: TracingExporterFile, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := startSpan(context.Background(), "FullSync")
+	span.End()
+	err = provider.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), `"Name":"FullSync"`) {
+		t.Errorf("Expected span in trace file, got %s", string(data))
+	}
+
+	_, err = NewTracerProvider(&TracingConfig{Exporter: "zipkin"})
+	if err == nil {
+		t.Error("Expected unsupported exporter to fail")
+	}
+}
@@ -0,0 +1,62 @@
+package layer
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	VectorSimilarityCosine    = "cosine"
+	VectorSimilarityEuclidean = "euclidean"
+)
+
+// largest vector dimension accepted by neo4j vector indexes
+const MaxVectorDimensions = 4096
+
+// floatVector converts an embedding property value to the float list stored for a vector index and
+// checks that it has the declared number of dimensions
+func floatVector(value any, dimensions int) ([]float64, error) {
+	var vector []float64
+	switch val := value.(type) {
+	case []float64:
+		vector = val
+	case []float32:
+		vector = make([]float64, 0, len(val))
+		for _, v := range val {
+			vector = append(vector, float64(v))
+		}
+	case []any:
+		vector = make([]float64, 0, len(val))
+		for _, v := range val {
+			f, ok := vectorElement(v)
+			if !ok {
+				return nil, fmt.Errorf("holds %T, expected a list of numbers", v)
+			}
+			vector = append(vector, f)
+		}
+	default:
+		return nil, fmt.Errorf("is a %T, expected a list of numbers", value)
+	}
+	if len(vector) != dimensions {
+		return nil, fmt.Errorf("has %d dimensions, expected %d", len(vector), dimensions)
+	}
+	return vector, nil
+}
+
+func vectorElement(v any) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case json.Number:
+		f, err := val.Float64()
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
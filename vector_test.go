@@ -0,0 +1,55 @@
+package layer
+
+import (
+	"context"
+	cdl "github.com/mimiro-io/common-datalayer"
+	egdm "github.com/mimiro-io/entity-graph-data-model"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestVectorProperties(t *testing.T) {
+	entity := makeEntity("1")
+	entity.SetProperty("http://data.sample.org/embedding", []any{0.5, 1, float32(0.25)})
+	item, err := nodeItem("people", entity, map[string]int{"embedding": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(item["embedding"].([]float64), []float64{0.5, 1, 0.25}) {
+		t.Errorf("Expected a float list, got %v", item["embedding"])
+	}
+
+	_, err = nodeItem("people", entity, map[string]int{"embedding": 4})
+	if err == nil || !strings.HasSuffix(err.Error(), "has 3 dimensions, expected 4") {
+		t.Errorf("Expected wrong dimensions, got %v", err)
+	}
+	entity.SetProperty("http://data.sample.org/embedding", []any{0.5, "x", 1})
+	_, err = nodeItem("people", entity, map[string]int{"embedding": 3})
+	if err == nil || !strings.HasSuffix(err.Error(), "holds string, expected a list of numbers") {
+		t.Errorf("Expected non numeric vector, got %v", err)
+	}
+
+	// a batch with an invalid embedding fails before anything is written
+	api := &fakeQueryAPI{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	client := NewNeo4jClient(server.URL, "", testCredentials, cdl.NewLogger("test", "text", "info"), newTestMetrics())
+	_, err = client.WriteBatch(context.Background(), "people", "Person", []*egdm.Entity{entity}, WriteOptions{Vectors: map[string]int{"embedding": 3}})
+	if err == nil || len(api.statements) != 0 {
+		t.Errorf("Expected the batch to fail without statements, got %v and %v", err, api.statements)
+	}
+
+	index := IndexConfig{Type: IndexTypeVector, Properties: []string{"embedding"}, Dimensions: 1536, Similarity: VectorSimilarityEuclidean}
+	expected := "CREATE VECTOR INDEX Person_vector_embedding IF NOT EXISTS FOR (n:Person) ON (n.embedding) OPTIONS {indexConfig: {`vector.dimensions`: 1536, `vector.similarity_function`: 'euclidean'}}"
+	if index.createStatement("Person") != expected {
+		t.Errorf("Unexpected statement %s", index.createStatement("Person"))
+	}
+
+	problems := configProblems{}
+	checkIndexes([]IndexConfig{{Type: IndexTypeVector, Properties: []string{"embedding"}, Similarity: "dot"}}, &problems)
+	if problems.Error() != "indexes[0].dimensions must be between 1 and 4096; unsupported indexes[0].similarity dot, must be cosine or euclidean" {
+		t.Errorf("Unexpected problems %s", problems.Error())
+	}
+}